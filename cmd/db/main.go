@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/5aradise/distributed-system/datastore"
@@ -9,18 +11,68 @@ import (
 	"github.com/5aradise/distributed-system/signal"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var port = flag.Int("port", 8083, "db server port")
+var (
+	port            = flag.Int("port", 8083, "db server port")
+	dir             = flag.String("dir", ".", "data directory")
+	segmentSize     = flag.Int64("segment-size", datastore.DefaultOptions().SegmentSize, "segment size in bytes")
+	mergeSegments   = flag.Int("merge-segments", datastore.DefaultOptions().MergePolicy.MinSegments, "number of segments that triggers a merge, negative disables merges")
+	garbageRatio    = flag.Float64("merge-garbage-ratio", datastore.DefaultOptions().MergePolicy.GarbageRatio, "share of dead bytes that makes a segment worth merging")
+	maxMergeSize    = flag.Int64("max-merge-size", 0, "max live bytes rewritten by a merge, 0 means unlimited")
+	readConcurrency = flag.Int("read-concurrency", 0, "max number of concurrent reads, 0 means unlimited")
+	mmapReads       = flag.Bool("mmap", false, "read closed segments through memory mappings")
+	cacheSize       = flag.Int64("cache-size", 0, "size in bytes of the value cache, 0 disables it")
+	maxKeySize      = flag.Int64("max-key-size", datastore.DefaultOptions().MaxKeySize, "max key size in bytes")
+	maxValueSize    = flag.Int64("max-value-size", datastore.DefaultOptions().MaxValueSize, "max value size in bytes")
+	syncInterval    = flag.Duration("sync-interval", datastore.DefaultOptions().SyncInterval, "flush period of the periodic sync policy")
+	restoreFrom     = flag.String("restore", "", "backup archive to restore into the empty data directory before starting")
+	keyFile         = flag.String("key-file", "", "file with encryption keys, one <id>:<hex key> per line, the last one is current; "+keysEnv+" is used when empty. Only values are encrypted, keys stay in plain text on disk")
+	syncPolicy      = datastore.SyncNone
+	compression     = datastore.CompressionNone
+)
+
+// keysEnv holds encryption keys in the format of the key file, separated
+// by commas.
+const keysEnv = "DB_ENCRYPTION_KEYS"
+
+func init() {
+	flag.Var(&syncPolicy, "sync", "when to flush writes to disk: none, always, group or periodic")
+	flag.Var(&compression, "compression", "when to compress values: none, put or merge")
+}
 
 type DbGetResponse struct {
+	Key string `json:"key"`
+	// Value is a JSON string or, for int64 values, a number.
+	Value   any    `json:"value"`
+	Type    string `json:"type"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+// DbEvent is a line of the change feed.
+type DbEvent struct {
+	Seq   uint64 `json:"seq"`
+	Event string `json:"event"`
 	Key   string `json:"key"`
-	Value string `json:"value"`
+	Value any    `json:"value,omitempty"`
+	Type  string `json:"type,omitempty"`
 }
 
 type DbPostRequest struct {
-	Value string `json:"value"`
+	Value json.RawMessage `json:"value"`
+	// Type is the type of Value: string, the default, or int64.
+	Type string `json:"type,omitempty"`
+	// Version makes the write conditional: it succeeds only if the key
+	// still has this version, 0 meaning that the key must not exist.
+	// It is supported for string values only.
+	Version *uint64 `json:"version,omitempty"`
+	// Increment atomically adds the number to the int64 value of the key
+	// instead of storing Value.
+	Increment *int64 `json:"increment,omitempty"`
 }
 
 var db *datastore.Db
@@ -28,8 +80,35 @@ var db *datastore.Db
 func main() {
 	flag.Parse()
 
-	var err error
-	db, err = datastore.Open(".")
+	keyring, err := loadKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+
+	if *restoreFrom != "" {
+		if err := restore(*restoreFrom); err != nil {
+			log.Fatalf("Failed to restore backup: %v", err)
+		}
+		log.Printf("Restored backup %s to %s", *restoreFrom, *dir)
+	}
+
+	db, err = datastore.OpenWithOptions(*dir, datastore.Options{
+		SegmentSize: *segmentSize,
+		MergePolicy: datastore.MergePolicy{
+			MinSegments:  *mergeSegments,
+			GarbageRatio: *garbageRatio,
+			MaxMergeSize: *maxMergeSize,
+		},
+		SyncPolicy:      syncPolicy,
+		SyncInterval:    *syncInterval,
+		ReadConcurrency: *readConcurrency,
+		MmapReads:       *mmapReads,
+		CacheSize:       *cacheSize,
+		MaxKeySize:      *maxKeySize,
+		MaxValueSize:    *maxValueSize,
+		Compression:     compression,
+		Keyring:         keyring,
+	})
 	if err != nil {
 		log.Fatalf("Failed to open datastore: %v", err)
 	}
@@ -41,6 +120,11 @@ func main() {
 
 	h.HandleFunc("/db/", dbHandler)
 
+	h.HandleFunc("/admin/stats", handleStats)
+	h.HandleFunc("/admin/backup", handleBackup)
+	h.HandleFunc("/admin/buckets/", handleDropBucket)
+	h.HandleFunc("/watch", handleWatch)
+
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
 		rw.WriteHeader(http.StatusOK)
@@ -56,9 +140,62 @@ func main() {
 	log.Println("DB service shutting down...")
 }
 
+func restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return datastore.Restore(f, *dir)
+}
+
+// loadKeyring reads the encryption keys from the key file or the
+// environment. No keys leave the data unencrypted.
+func loadKeyring() (datastore.Keyring, error) {
+	keys := os.Getenv(keysEnv)
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return datastore.Keyring{}, err
+		}
+		keys = string(data)
+	}
+
+	keyring := datastore.Keyring{Keys: make(map[uint16][]byte)}
+	for _, line := range strings.FieldsFunc(keys, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		idStr, keyHex, ok := strings.Cut(line, ":")
+		if !ok {
+			return datastore.Keyring{}, fmt.Errorf("bad key %q, want <id>:<hex key>", line)
+		}
+		id, err := strconv.ParseUint(idStr, 10, 16)
+		if err != nil {
+			return datastore.Keyring{}, fmt.Errorf("bad key ID %q: %w", idStr, err)
+		}
+		key, err := hex.DecodeString(keyHex)
+		if err != nil {
+			return datastore.Keyring{}, fmt.Errorf("bad key %d: %w", id, err)
+		}
+		keyring.Keys[uint16(id)] = key
+		keyring.Current = uint16(id)
+	}
+	return keyring, nil
+}
+
 func dbHandler(rw http.ResponseWriter, r *http.Request) {
 	trimmedPath := strings.TrimPrefix(r.URL.Path, "/db/")
-	if trimmedPath == "" || strings.Contains(trimmedPath, "/") {
+	if bucket, key, ok := strings.Cut(trimmedPath, "/"); ok {
+		if bucket == "" || key == "" || strings.Contains(key, "/") {
+			http.Error(rw, "Invalid key in path. Expected /db/<bucket>/<key>", http.StatusBadRequest)
+			return
+		}
+		bucketHandler(rw, r, db.Bucket(bucket), key)
+		return
+	}
+	if trimmedPath == "" {
 		http.Error(rw, "Invalid key in path. Expected /db/<key>", http.StatusBadRequest)
 		return
 	}
@@ -69,13 +206,80 @@ func dbHandler(rw http.ResponseWriter, r *http.Request) {
 		handleGet(rw, key)
 	case http.MethodPost:
 		handlePost(rw, r, key)
+	case http.MethodDelete:
+		handleDelete(rw, key)
+	default:
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bucketHandler serves the keys of a named bucket, which hold string
+// values only.
+func bucketHandler(rw http.ResponseWriter, r *http.Request, bucket *datastore.Bucket, key string) {
+	switch r.Method {
+	case http.MethodGet:
+		value, err := bucket.Get(key)
+		if err != nil {
+			if err == datastore.ErrNotFound {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			log.Printf("Error getting value for key %s of bucket %s: %v", key, bucket.Name(), err)
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		resp := DbGetResponse{Key: key, Value: value, Type: datastore.TypeString.String()}
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			log.Printf("Error encoding response for key %s: %v", key, err)
+		}
+	case http.MethodPost:
+		var req DbPostRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid JSON body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if req.Type != "" && req.Type != datastore.TypeString.String() || req.Version != nil || req.Increment != nil {
+			http.Error(rw, "Buckets support plain string values only", http.StatusBadRequest)
+			return
+		}
+		var value string
+		if err := json.Unmarshal(req.Value, &value); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid string value: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := bucket.Put(key, value); err != nil {
+			if errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) {
+				http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("Error putting value for key %s of bucket %s: %v", key, bucket.Name(), err)
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if err := bucket.Delete(key); err != nil {
+			if err == datastore.ErrNotFound {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			log.Printf("Error deleting key %s of bucket %s: %v", key, bucket.Name(), err)
+			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
 	default:
 		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func handleGet(rw http.ResponseWriter, key string) {
-	value, err := db.Get(key)
+	value, err := db.GetTyped(key)
 	if err != nil {
 		if err == datastore.ErrNotFound {
 			rw.WriteHeader(http.StatusNotFound)
@@ -88,11 +292,144 @@ func handleGet(rw http.ResponseWriter, key string) {
 
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(rw).Encode(DbGetResponse{Key: key, Value: value}); err != nil {
+	if err := json.NewEncoder(rw).Encode(newGetResponse(key, value)); err != nil {
 		log.Printf("Error encoding response for key %s: %v", key, err)
 	}
 }
 
+func handleStats(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(db.Stats()); err != nil {
+		log.Printf("Error encoding stats: %v", err)
+	}
+}
+
+// handleDropBucket deletes the bucket named in the path with all its keys.
+func handleDropBucket(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/buckets/")
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(rw, "Invalid bucket in path. Expected /admin/buckets/<name>", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DropBucket(name); err != nil {
+		if err == datastore.ErrNoBucket {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("Error dropping bucket %s: %v", name, err)
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// handleBackup streams a backup archive of the database. Writes go on
+// while it is sent.
+func handleBackup(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A large backup outlives the write timeout of the server.
+	if err := http.NewResponseController(rw).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline: %v", err)
+	}
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", `attachment; filename="backup.tar"`)
+	rw.WriteHeader(http.StatusOK)
+	if err := db.Backup(rw); err != nil {
+		log.Printf("Error writing backup: %v", err)
+	}
+}
+
+// handleWatch streams the changes of the keys with the prefix query
+// parameter as newline-delimited JSON. With the from parameter the feed
+// resumes after that sequence number.
+func handleWatch(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	var (
+		events <-chan datastore.Event
+		cancel func()
+	)
+	if from := query.Get("from"); from != "" {
+		seq, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid from sequence number", http.StatusBadRequest)
+			return
+		}
+		events, cancel = db.WatchFrom(prefix, seq)
+	} else {
+		events, cancel = db.Watch(prefix)
+	}
+	defer cancel()
+
+	// The feed outlives the write timeout of the server.
+	rc := http.NewResponseController(rw)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline: %v", err)
+	}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(rw)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := enc.Encode(newEvent(event)); err != nil {
+				log.Printf("Error writing change feed: %v", err)
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func newEvent(event datastore.Event) DbEvent {
+	res := DbEvent{Seq: event.Seq, Event: event.Kind.String(), Key: event.Key}
+	if event.Kind == datastore.EventPut {
+		value := newGetResponse(event.Key, event.Value)
+		res.Value, res.Type = value.Value, value.Type
+	}
+	return res
+}
+
+func newGetResponse(key string, value datastore.TypedValue) DbGetResponse {
+	resp := DbGetResponse{Key: key, Type: value.Type.String(), Version: value.Version}
+	if value.Type == datastore.TypeInt64 {
+		resp.Value = value.Int64
+	} else {
+		resp.Value = value.String
+	}
+	return resp
+}
+
 func handlePost(rw http.ResponseWriter, r *http.Request, key string) {
 	var req DbPostRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -101,10 +438,94 @@ func handlePost(rw http.ResponseWriter, r *http.Request, key string) {
 	}
 	defer r.Body.Close()
 
-	if err := db.Put(key, req.Value); err != nil {
+	if req.Increment != nil {
+		handleIncrement(rw, key, *req.Increment)
+		return
+	}
+
+	valueType := datastore.TypeString
+	if req.Type != "" {
+		var err error
+		if valueType, err = datastore.ParseValueType(req.Type); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if valueType != datastore.TypeString && req.Version != nil {
+		http.Error(rw, "Version is supported for string values only", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch valueType {
+	case datastore.TypeInt64:
+		var value int64
+		if err := json.Unmarshal(req.Value, &value); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid int64 value: %v", err), http.StatusBadRequest)
+			return
+		}
+		err = db.PutInt64(key, value)
+	default:
+		var value string
+		if err := json.Unmarshal(req.Value, &value); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid string value: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Version != nil {
+			_, err = db.CompareAndSwap(key, *req.Version, value)
+		} else {
+			err = db.Put(key, value)
+		}
+	}
+	if err != nil {
+		if err == datastore.ErrVersionMismatch {
+			http.Error(rw, "Version Conflict", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err == datastore.ErrReservedKey {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
 		log.Printf("Error putting value for key %s: %v", key, err)
 		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	rw.WriteHeader(http.StatusOK)
 }
+
+func handleIncrement(rw http.ResponseWriter, key string, delta int64) {
+	value, err := db.Increment(key, delta)
+	if err != nil {
+		if errors.Is(err, datastore.ErrTypeMismatch) {
+			http.Error(rw, "Value is not an int64", http.StatusConflict)
+			return
+		}
+		log.Printf("Error incrementing key %s: %v", key, err)
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	resp := DbGetResponse{Key: key, Value: value, Type: datastore.TypeInt64.String()}
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		log.Printf("Error encoding response for key %s: %v", key, err)
+	}
+}
+
+func handleDelete(rw http.ResponseWriter, key string) {
+	if err := db.Delete(key); err != nil {
+		if err == datastore.ErrNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("Error deleting key %s: %v", key, err)
+		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,291 @@
+package datastore
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	backupInfoName    = "BACKUP"
+	backupMagic       = "dbak"
+	backupVersion     = 2
+	backupHeaderSize  = 17
+	backupSegmentSize = 16
+)
+
+// A backup is a tar archive of the segment files followed by the BACKUP
+// file, which lists them from the oldest to the newest with their sizes
+// and checksums.
+//
+// 0       4         5        13       17                           <-- offset
+// (magic) (version) (seq)    (count)  (segments...) (buckets...) (crc32)
+// 4       1         8        4        ....          ....         4  <-- length
+//
+// segment:
+// (nl) (name) (size) (crc32)
+// 4    ....   8      4
+//
+// Version 2 adds the bucket registry, see appendBuckets.
+
+var errBadBackup = errors.New("bad backup")
+
+type backupSegment struct {
+	name string
+	size int64
+	crc  uint32
+}
+
+// Backup writes a tar archive of the database to w. The archive holds the
+// records written before the call; writes and merges go on while it is
+// written, the segments it copies are pinned until it is done.
+func (db *Db) Backup(w io.Writer) error {
+	db.mu.Lock()
+	segments := slices.Clone(db.segments)
+	infos := make([]backupSegment, len(segments))
+	for i, seg := range segments {
+		seg.pins++
+		infos[i] = backupSegment{name: filepath.Base(seg.path), size: seg.size}
+	}
+	seq := db.lastSeq
+	buckets := db.buckets.clone()
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.unpinSegments(segments)
+		db.mu.Unlock()
+	}()
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for i, seg := range segments {
+		crc, err := db.backupSegment(tw, seg, infos[i], now)
+		if err != nil {
+			return fmt.Errorf("failed to back up %s: %w", infos[i].name, err)
+		}
+		infos[i].crc = crc
+	}
+
+	info := encodeBackupInfo(seq, infos, buckets)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    backupInfoName,
+		Mode:    int64(db.opts.FileMode),
+		Size:    int64(len(info)),
+		ModTime: now,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(info); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// backupSegment copies the first info.size bytes of seg to the archive
+// and returns their checksum.
+func (db *Db) backupSegment(tw *tar.Writer, seg *segment, info backupSegment, now time.Time) (uint32, error) {
+	f, err := db.openPinned(seg)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    info.name,
+		Mode:    int64(db.opts.FileMode),
+		Size:    info.size,
+		ModTime: now,
+	}); err != nil {
+		return 0, err
+	}
+	crc := crc32.New(crcTable)
+	if _, err := io.Copy(io.MultiWriter(tw, crc), io.NewSectionReader(f, 0, info.size)); err != nil {
+		return 0, err
+	}
+	return crc.Sum32(), nil
+}
+
+// Restore rebuilds the database saved by Backup in dir, which must be
+// missing or empty. The segments are checked against the checksums of the
+// backup and their records are verified before the manifest is written.
+// On failure the restored files are removed.
+func Restore(r io.Reader, dir string) (err error) {
+	opts := DefaultOptions()
+	if files, err := os.ReadDir(dir); err == nil && len(files) > 0 {
+		return fmt.Errorf("cannot restore to %s: directory is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, opts.DirMode); err != nil {
+		return err
+	}
+
+	var restored []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, path := range restored {
+			os.Remove(path)
+		}
+	}()
+
+	var (
+		files = make(map[string]backupSegment)
+		info  []byte
+	)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+
+		switch {
+		case h.Name == backupInfoName:
+			if info, err = io.ReadAll(tr); err != nil {
+				return fmt.Errorf("failed to read backup: %w", err)
+			}
+		case strings.HasPrefix(h.Name, segmentPrefix) && h.Name == filepath.Base(h.Name) &&
+			!strings.HasSuffix(h.Name, hintSuffix):
+			if _, ok := files[h.Name]; ok {
+				return fmt.Errorf("%w: duplicate segment %s", errBadBackup, h.Name)
+			}
+			path := filepath.Join(dir, h.Name)
+			restored = append(restored, path)
+			file, err := restoreFile(path, tr, opts.FileMode)
+			if err != nil {
+				return fmt.Errorf("failed to restore %s: %w", h.Name, err)
+			}
+			files[h.Name] = file
+		default:
+			return fmt.Errorf("%w: unexpected file %s", errBadBackup, h.Name)
+		}
+	}
+	if info == nil {
+		return fmt.Errorf("%w: %s is missing", errBadBackup, backupInfoName)
+	}
+	seq, listed, buckets, err := decodeBackupInfo(info)
+	if err != nil {
+		return err
+	}
+	if len(listed) != len(files) {
+		return fmt.Errorf("%w: %d segments listed, %d found", errBadBackup, len(listed), len(files))
+	}
+
+	segments := make([]*segment, len(listed))
+	for i, want := range listed {
+		got, ok := files[want.name]
+		switch {
+		case !ok:
+			return fmt.Errorf("%w: segment %s is missing", errBadBackup, want.name)
+		case got.size != want.size:
+			return fmt.Errorf("%w: segment %s has %d bytes, want %d", errBadBackup, want.name, got.size, want.size)
+		case got.crc != want.crc:
+			return fmt.Errorf("%w: segment %s: checksum mismatch", errBadBackup, want.name)
+		}
+
+		seg := &segment{path: filepath.Join(dir, want.name), size: want.size}
+		if _, err := scanSegment(seg, false, true); err != nil {
+			return fmt.Errorf("%w: segment %s: %w", errBadBackup, want.name, err)
+		}
+		segments[i] = seg
+	}
+
+	restored = append(restored, manifestPath(dir))
+	return writeManifest(dir, segments, buckets, seq, opts.FileMode)
+}
+
+// restoreFile writes the contents of r to a new file at path and returns
+// their size and checksum.
+func restoreFile(path string, r io.Reader, perm os.FileMode) (backupSegment, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return backupSegment{}, err
+	}
+	crc := crc32.New(crcTable)
+	size, err := io.Copy(io.MultiWriter(f, crc), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return backupSegment{}, err
+	}
+	return backupSegment{size: size, crc: crc.Sum32()}, nil
+}
+
+func encodeBackupInfo(seq uint64, segments []backupSegment, buckets bucketRegistry) []byte {
+	buf := make([]byte, backupHeaderSize)
+	copy(buf, backupMagic)
+	buf[4] = backupVersion
+	binary.LittleEndian.PutUint64(buf[5:], seq)
+	binary.LittleEndian.PutUint32(buf[13:], uint32(len(segments)))
+	for _, seg := range segments {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(seg.name)))
+		buf = append(buf, seg.name...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(seg.size))
+		buf = binary.LittleEndian.AppendUint32(buf, seg.crc)
+	}
+	buf = appendBuckets(buf, buckets)
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+func decodeBackupInfo(buf []byte) (uint64, []backupSegment, bucketRegistry, error) {
+	fail := func(format string, args ...any) (uint64, []backupSegment, bucketRegistry, error) {
+		return 0, nil, bucketRegistry{}, fmt.Errorf("%w: %s: %s", errBadBackup, backupInfoName, fmt.Sprintf(format, args...))
+	}
+	if len(buf) < backupHeaderSize+4 {
+		return fail("too short")
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return fail("checksum mismatch")
+	}
+	version := body[4]
+	if string(body[:4]) != backupMagic || version < 1 || version > backupVersion {
+		return fail("unknown format")
+	}
+
+	seq := binary.LittleEndian.Uint64(body[5:])
+	count := int(binary.LittleEndian.Uint32(body[13:]))
+	segments := make([]backupSegment, 0, count)
+	rest := body[backupHeaderSize:]
+	for len(segments) < count {
+		name, ok := decodeString(rest)
+		if !ok || len(rest) < backupSegmentSize+len(name) {
+			return fail("truncated segment")
+		}
+		rest = rest[4+len(name):]
+		segments = append(segments, backupSegment{
+			name: name,
+			size: int64(binary.LittleEndian.Uint64(rest)),
+			crc:  binary.LittleEndian.Uint32(rest[8:]),
+		})
+		rest = rest[backupSegmentSize-4:]
+	}
+
+	buckets := newBucketRegistry()
+	if version >= 2 {
+		var err error
+		if buckets, rest, err = decodeBuckets(rest); err != nil {
+			return fail("%v", err)
+		}
+	}
+	if len(rest) != 0 {
+		return fail("trailing data")
+	}
+	return seq, segments, buckets, nil
+}
@@ -0,0 +1,175 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	opts := Options{SegmentSize: 256, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := range 20 {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := range 50 {
+			if err := db.Put(fmt.Sprintf("late%d", i), strings.Repeat("x", 20)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		db.MergeSegments()
+	}()
+	var archive bytes.Buffer
+	close(start)
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	dir := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(bytes.NewReader(archive.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatalf("Open of the restored directory failed: %v", err)
+	}
+	defer restored.Close()
+
+	if _, err := restored.Get("key0"); err != ErrNotFound {
+		t.Errorf("Get(key0) error = %v; want ErrNotFound", err)
+	}
+	for i := 1; i < 10; i++ {
+		key, want := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i+10)
+		if value, err := restored.Get(key); err != nil || value != want {
+			t.Errorf("Get(%s) = %q, %v; want %q", key, value, err, want)
+		}
+	}
+
+	// The segments pinned by the backup are released.
+	files, err := os.ReadDir(db.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), retiredPrefix) {
+			t.Errorf("retired segment %s is left after the backup", file.Name())
+		}
+	}
+}
+
+func TestRestore_Damaged(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("segment", func(t *testing.T) {
+		damaged := rewriteArchive(t, archive.Bytes(), func(name string, data []byte) []byte {
+			if strings.HasPrefix(name, segmentPrefix) {
+				data[len(data)-1] ^= 0xff
+			}
+			return data
+		})
+		dir := t.TempDir()
+		if err := Restore(bytes.NewReader(damaged), dir); !errors.Is(err, errBadBackup) {
+			t.Errorf("Restore error = %v; want errBadBackup", err)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Errorf("failed Restore left %d files", len(files))
+		}
+	})
+
+	t.Run("missing info", func(t *testing.T) {
+		damaged := rewriteArchive(t, archive.Bytes(), func(name string, data []byte) []byte {
+			if name == backupInfoName {
+				return nil
+			}
+			return data
+		})
+		if err := Restore(bytes.NewReader(damaged), t.TempDir()); !errors.Is(err, errBadBackup) {
+			t.Errorf("Restore error = %v; want errBadBackup", err)
+		}
+	})
+
+	t.Run("not empty", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := Restore(bytes.NewReader(archive.Bytes()), dir); err == nil {
+			t.Error("Restore to a directory with files succeeded")
+		}
+	})
+}
+
+// rewriteArchive copies the tar archive passing every file through edit,
+// files it returns nil for are dropped.
+func rewriteArchive(t *testing.T, archive []byte, edit func(name string, data []byte) []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tw := tar.NewWriter(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data = edit(h.Name, data); data == nil {
+			continue
+		}
+		h.Size = int64(len(data))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"encoding/binary"
+)
+
+// WriteBatch collects updates that Db.Write applies atomically: after a
+// crash either all of them are visible or none.
+type WriteBatch struct {
+	entries []entry
+}
+
+func (b *WriteBatch) Put(key, value string) {
+	b.entries = append(b.entries, entry{
+		kind:  kindPut,
+		key:   key,
+		value: value,
+	})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, entry{
+		kind: kindDelete,
+		key:  key,
+	})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write applies all updates of the batch in order. Unlike Delete, deleting
+// a missing key in a batch is not an error.
+func (db *Db) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	entries := make([]entry, 0, len(b.entries)+2)
+	entries = append(entries, entry{
+		kind:  kindBatchBegin,
+		value: string(binary.LittleEndian.AppendUint32(nil, uint32(len(b.entries)))),
+	})
+	entries = append(entries, b.entries...)
+	entries = append(entries, entry{
+		kind: kindBatchCommit,
+	})
+	return db.write(entries...)
+}
+
+func batchSize(begin entry) (int, bool) {
+	if len(begin.value) != 4 {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint32([]byte(begin.value))), true
+}
@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 1024}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b WriteBatch
+	b.Put("k2", "v2")
+	b.Put("k3", "v3")
+	b.Delete("k1")
+	b.Delete("missing")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		if _, err := db.Get("k1"); err != ErrNotFound {
+			t.Errorf("Get(k1) = %v; want ErrNotFound", err)
+		}
+		for k, v := range map[string]string{"k2": "v2", "k3": "v3"} {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, v)
+			}
+		}
+	}
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+
+	t.Run("torn batch", func(t *testing.T) {
+		b.Reset()
+		b.Put("k2", "v2.1")
+		b.Put("k4", "v4")
+		if err := db.Write(&b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		segments := segmentFiles(t, tmp)
+		last := segments[len(segments)-1]
+		info, err := os.Stat(last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitSize := int64(len((&entry{kind: kindBatchCommit}).Encode()))
+		if err := os.Truncate(last, info.Size()-commitSize); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatalf("Open after torn batch failed: %v", err)
+		}
+		defer db.Close()
+
+		check(t, db)
+		if _, err := db.Get("k4"); err != ErrNotFound {
+			t.Errorf("Get(k4) = %v; want ErrNotFound for the incomplete batch", err)
+		}
+	})
+}
@@ -0,0 +1,373 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// The keys of a named bucket are kept in the index under the prefix of the
+// bucket: a zero byte and the bucket ID in big endian. The index is
+// ordered, so every bucket owns a contiguous range of it, which is walked
+// to scan, count or drop the bucket. Keys of the default bucket are stored
+// as they are and must not start with a zero byte.
+const (
+	bucketKeyMarker     = "\x00"
+	bucketKeyPrefixSize = 5
+	maxBucketNameSize   = 255
+)
+
+// ErrReservedKey is also returned by Open for data written before buckets
+// that holds such keys in the default bucket. They would be read as keys
+// of the named buckets, so they have to be deleted with an older version
+// first.
+var (
+	ErrNoBucket    = errors.New("bucket does not exist")
+	ErrReservedKey = errors.New("keys starting with a zero byte are reserved")
+)
+
+// reservedKey reports whether a key of the default bucket would reach into
+// the named buckets. Writes of such keys fail and reads miss them.
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, bucketKeyMarker)
+}
+
+func bucketPrefix(bucket uint32) string {
+	if bucket == 0 {
+		return ""
+	}
+	return bucketKeyMarker + string(binary.BigEndian.AppendUint32(nil, bucket))
+}
+
+// indexKey returns the key of the record in the index.
+func (e *entry) indexKey() string {
+	return bucketPrefix(e.bucket) + e.key
+}
+
+// indexBucket returns the bucket ID of an index key.
+func indexBucket(key string) uint32 {
+	if len(key) < bucketKeyPrefixSize || !strings.HasPrefix(key, bucketKeyMarker) {
+		return 0
+	}
+	return binary.BigEndian.Uint32([]byte(key[1:bucketKeyPrefixSize]))
+}
+
+// bucketRange returns the index prefix and start of the keys of bucket
+// with prefix starting from start. It reports false when there are none.
+func bucketRange(bucket uint32, prefix, start string) (string, string, bool) {
+	if bucket != 0 {
+		p := bucketPrefix(bucket)
+		return p + prefix, p + start, true
+	}
+	if strings.HasPrefix(prefix, bucketKeyMarker) {
+		return "", "", false
+	}
+	// Skip the keys of the named buckets, which are ordered first.
+	return prefix, max(start, "\x01"), true
+}
+
+// bucketRegistry maps the names of buckets to their IDs. IDs are never
+// reused, so the records a dropped bucket leaves in the segments do not
+// show up in a new one.
+type bucketRegistry struct {
+	ids   map[string]uint32
+	names map[uint32]string
+	last  uint32
+}
+
+func newBucketRegistry() bucketRegistry {
+	return bucketRegistry{
+		ids:   make(map[string]uint32),
+		names: make(map[uint32]string),
+	}
+}
+
+// has reports whether the bucket exists, the default one always does.
+func (r bucketRegistry) has(id uint32) bool {
+	_, ok := r.names[id]
+	return id == 0 || ok
+}
+
+func (r *bucketRegistry) add(name string, id uint32) {
+	r.ids[name] = id
+	r.names[id] = name
+	r.last = max(r.last, id)
+}
+
+func (r *bucketRegistry) remove(name string) {
+	delete(r.names, r.ids[name])
+	delete(r.ids, name)
+}
+
+func (r bucketRegistry) clone() bucketRegistry {
+	return bucketRegistry{
+		ids:   maps.Clone(r.ids),
+		names: maps.Clone(r.names),
+		last:  r.last,
+	}
+}
+
+// The bucket registry is stored in the manifest and the backup info:
+//
+// (last id) (count) (buckets...)
+// 4         4       ....
+//
+// bucket:
+// (id) (nl) (name)
+// 4    4    ....
+
+func appendBuckets(buf []byte, r bucketRegistry) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, r.last)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(r.ids)))
+	for _, name := range slices.Sorted(maps.Keys(r.ids)) {
+		buf = binary.LittleEndian.AppendUint32(buf, r.ids[name])
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	return buf
+}
+
+func decodeBuckets(buf []byte) (bucketRegistry, []byte, error) {
+	r := newBucketRegistry()
+	if len(buf) < 8 {
+		return r, nil, errors.New("truncated bucket registry")
+	}
+	last := binary.LittleEndian.Uint32(buf)
+	count := int(binary.LittleEndian.Uint32(buf[4:]))
+	buf = buf[8:]
+	for range count {
+		if len(buf) < 4 {
+			return r, nil, errors.New("truncated bucket")
+		}
+		id := binary.LittleEndian.Uint32(buf)
+		name, ok := decodeString(buf[4:])
+		if !ok {
+			return r, nil, errors.New("truncated bucket")
+		}
+		if id == 0 || id > last {
+			return r, nil, fmt.Errorf("bad ID %d of bucket %q", id, name)
+		}
+		r.add(name, id)
+		buf = buf[8+len(name):]
+	}
+	r.last = last
+	return r, buf, nil
+}
+
+// Bucket is a named keyspace of a Db. Buckets share the segments, merges
+// and options of the Db, but a key of one bucket never sees the keys of
+// another. A bucket is created by its first write.
+type Bucket struct {
+	db   *Db
+	name string
+}
+
+// Bucket returns the bucket with the name, the empty name stands for the
+// default bucket that the methods of Db work with.
+func (db *Db) Bucket(name string) *Bucket {
+	return &Bucket{db: db, name: name}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// id returns the ID of the bucket, registering a new bucket when create
+// is set.
+func (b *Bucket) id(create bool) (uint32, error) {
+	db := b.db
+	if b.name == "" {
+		return 0, nil
+	}
+	db.mu.RLock()
+	id, ok := db.buckets.ids[b.name]
+	db.mu.RUnlock()
+	if ok || !create {
+		if !ok {
+			return 0, ErrNoBucket
+		}
+		return id, nil
+	}
+
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	if len(b.name) > maxBucketNameSize {
+		return 0, fmt.Errorf("bucket name is longer than %d bytes", maxBucketNameSize)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if id, ok := db.buckets.ids[b.name]; ok {
+		return id, nil
+	}
+	id = db.buckets.last + 1
+	db.buckets.add(b.name, id)
+	if err := db.saveManifest(db.segments); err != nil {
+		db.buckets.remove(b.name)
+		db.buckets.last--
+		return 0, err
+	}
+	return id, nil
+}
+
+func (b *Bucket) Put(key, value string) error {
+	id, err := b.id(true)
+	if err != nil {
+		return err
+	}
+	return b.db.write(entry{
+		kind:   kindPut,
+		key:    key,
+		value:  value,
+		bucket: id,
+	})
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	id, err := b.id(false)
+	if err == ErrNoBucket {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return b.db.get(bucketPrefix(id) + key)
+}
+
+func (b *Bucket) Delete(key string) error {
+	id, err := b.id(false)
+	if err == ErrNoBucket {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return b.db.delete(entry{kind: kindDelete, key: key, bucket: id})
+}
+
+// Scan works like Db.Scan on the keys of the bucket.
+func (b *Bucket) Scan(prefix, start string, limit int) ([]KeyValue, error) {
+	id, err := b.id(false)
+	if err == ErrNoBucket {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b.db.scan(id, prefix, start, limit)
+}
+
+// BucketStats describes the keys of a bucket.
+type BucketStats struct {
+	Name string `json:"name"`
+	Keys int    `json:"keys"`
+	// LiveBytes is the size of the latest records of the keys.
+	LiveBytes int64 `json:"liveBytes"`
+}
+
+// Stats counts the keys of the bucket and their bytes.
+func (b *Bucket) Stats() (BucketStats, error) {
+	id, err := b.id(false)
+	if err != nil {
+		return BucketStats{}, err
+	}
+
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	return b.db.bucketStats(b.name, id), nil
+}
+
+// bucketStats must be called under db.mu.
+func (db *Db) bucketStats(name string, id uint32) BucketStats {
+	stats := BucketStats{Name: name}
+	prefix, start, _ := bucketRange(id, "", "")
+	for _, loc := range db.rangeKeys(prefix, start) {
+		stats.Keys++
+		stats.LiveBytes += loc.size
+	}
+	return stats
+}
+
+// Buckets returns the names of the named buckets in order.
+func (db *Db) Buckets() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Sorted(maps.Keys(db.buckets.ids))
+}
+
+// DropBucket deletes the bucket with all its keys. The bucket is dropped
+// from the manifest at once, its records are left for merges to remove and
+// are ignored on Open.
+func (db *Db) DropBucket(name string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	id, ok := db.buckets.ids[name]
+	if !ok {
+		return ErrNoBucket
+	}
+	db.buckets.remove(name)
+	if err := db.saveManifest(db.segments); err != nil {
+		db.buckets.add(name, id)
+		return err
+	}
+
+	prefix := bucketPrefix(id)
+	var keys []string
+	for key, loc := range rangeIndex(db.index, prefix, "") {
+		keys = append(keys, key)
+		// Records written over in the active segment are dead already.
+		if _, inActive := db.activeSegment.index.get(key); !inActive {
+			loc.segment.dead += loc.size
+		}
+	}
+	for _, key := range keys {
+		db.index.delete(key)
+	}
+	closed := len(keys)
+	for key, loc := range rangeIndex(db.activeSegment.index, prefix, "") {
+		keys = append(keys, key)
+		loc.segment.dead += loc.size
+	}
+	for _, key := range keys[closed:] {
+		db.activeSegment.index.delete(key)
+	}
+	for key, loc := range db.activeSegment.deleted {
+		if strings.HasPrefix(key, prefix) {
+			delete(db.activeSegment.deleted, key)
+			loc.segment.dead += loc.size
+		}
+	}
+	if db.cache != nil {
+		for _, key := range keys {
+			db.cache.remove(key)
+		}
+	}
+	return nil
+}
+
+// dropUnknownBuckets removes the keys of buckets missing from the registry
+// from keys recovered from a segment.
+func (db *Db) dropUnknownBuckets(keys segmentKeys) {
+	var dropped []string
+	for key := range rangeIndex(keys.index, bucketKeyMarker, "") {
+		if !db.buckets.has(indexBucket(key)) {
+			dropped = append(dropped, key)
+		}
+	}
+	for _, key := range dropped {
+		keys.index.delete(key)
+	}
+	for key := range keys.deleted {
+		if !db.buckets.has(indexBucket(key)) {
+			delete(keys.deleted, key)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 256, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	users, items := db.Bucket("users"), db.Bucket("items")
+	for i := range 5 {
+		key := fmt.Sprintf("key%d", i)
+		if err := db.Put(key, "default"); err != nil {
+			t.Fatal(err)
+		}
+		if err := users.Put(key, "user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := items.Put("key0", "item"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete("key4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := items.Delete("key4"); err != ErrNotFound {
+		t.Errorf("Delete of a missing key: %v, want %v", err, ErrNotFound)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		users, items := db.Bucket("users"), db.Bucket("items")
+		for _, tc := range []struct {
+			get   func(string) (string, error)
+			key   string
+			value string
+		}{
+			{db.Get, "key0", "default"},
+			{db.Get, "key4", "default"},
+			{users.Get, "key0", "user"},
+			{items.Get, "key0", "item"},
+			{users.Get, "key4", ""},
+			{items.Get, "key1", ""},
+			{db.Bucket("other").Get, "key0", ""},
+		} {
+			value, err := tc.get(tc.key)
+			if tc.value == "" {
+				if err != ErrNotFound {
+					t.Errorf("Get(%s) = %q, %v, want %v", tc.key, value, err, ErrNotFound)
+				}
+			} else if err != nil || value != tc.value {
+				t.Errorf("Get(%s) = %q, %v, want %q", tc.key, value, err, tc.value)
+			}
+		}
+
+		got, err := users.Scan("key", "key1", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []KeyValue{{"key1", "user"}, {"key2", "user"}, {"key3", "user"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Scan of the bucket = %v, want %v", got, want)
+		}
+		if got, err := db.Scan("", "", 0); err != nil || len(got) != 5 {
+			t.Errorf("Scan of the default bucket = %v, %v, want 5 keys", got, err)
+		}
+
+		if got := db.Buckets(); !reflect.DeepEqual(got, []string{"items", "users"}) {
+			t.Errorf("Buckets() = %v", got)
+		}
+		stats := db.Stats()
+		if stats.Keys != 10 {
+			t.Errorf("Stats().Keys = %d, want 10", stats.Keys)
+		}
+		if len(stats.Buckets) != 2 || stats.Buckets[0].Keys != 1 || stats.Buckets[1].Keys != 4 {
+			t.Errorf("Stats().Buckets = %+v", stats.Buckets)
+		}
+		if bs, err := users.Stats(); err != nil || bs != stats.Buckets[1] {
+			t.Errorf("users.Stats() = %+v, %v, want %+v", bs, err, stats.Buckets[1])
+		}
+	}
+	check(db)
+
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	db.MergeSegments()
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	restoredDir := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(&archive, restoredDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := OpenWithOptions(restoredDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	check(restored)
+}
+
+func TestDropBucket(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 256, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	logs := db.Bucket("logs")
+	for i := range 10 {
+		if err := logs.Put(fmt.Sprintf("key%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key0", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.Delete("key9"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DropBucket("logs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("logs"); err != ErrNoBucket {
+		t.Errorf("second DropBucket: %v, want %v", err, ErrNoBucket)
+	}
+	if _, err := logs.Get("key0"); err != ErrNotFound {
+		t.Errorf("Get of a dropped bucket: %v, want %v", err, ErrNotFound)
+	}
+	stats := db.Stats()
+	if stats.Keys != 1 || len(stats.Buckets) != 0 {
+		t.Errorf("Stats() after drop: %d keys, buckets %+v", stats.Keys, stats.Buckets)
+	}
+	var size int64
+	for _, seg := range stats.Segments {
+		size += seg.Size - segmentHeaderSize
+	}
+	if stats.LiveBytes+stats.DeadBytes != size {
+		t.Errorf("live %d + dead %d bytes, want %d", stats.LiveBytes, stats.DeadBytes, size)
+	}
+
+	// The recreated bucket does not see the records of the dropped one.
+	if err := logs.Put("key1", "new"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *Db) {
+		t.Helper()
+		logs := db.Bucket("logs")
+		got, err := logs.Scan("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []KeyValue{{"key1", "new"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Scan of the recreated bucket = %v, want %v", got, want)
+		}
+		if value, err := db.Get("key0"); err != nil || value != "default" {
+			t.Errorf("Get(key0) = %q, %v", value, err)
+		}
+		if stats := db.Stats(); stats.Keys != 2 {
+			t.Errorf("Stats().Keys = %d, want 2", stats.Keys)
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	rotate(t, db)
+	db.MergeSegments()
+	check(db)
+	if stats := db.Stats(); stats.DeadBytes != 0 {
+		t.Errorf("%d dead bytes after a full merge", stats.DeadBytes)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("\x00key", "value"); err != ErrReservedKey {
+		t.Errorf("Put of a reserved key: %v, want %v", err, ErrReservedKey)
+	}
+	if err := db.Bucket("bucket").Put("\x00key", "value"); err != nil {
+		t.Errorf("Put of a zero byte key to a bucket: %v", err)
+	}
+	if got, err := db.Scan("\x00", "", 0); err != nil || len(got) != 0 {
+		t.Errorf("Scan of reserved keys = %v, %v", got, err)
+	}
+}
+
+func TestReservedKeys_Reads(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	team := db.Bucket("team")
+	if err := team.Put("secret", "value"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := team.id(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The index key of the bucket record must not be readable through
+	// the default bucket.
+	key := bucketPrefix(id) + "secret"
+
+	if value, err := db.Get(key); err != ErrNotFound {
+		t.Errorf("Get = %q, %v, want %v", value, err, ErrNotFound)
+	}
+	if value, _, err := db.GetWithVersion(key); err != ErrNotFound {
+		t.Errorf("GetWithVersion = %q, %v, want %v", value, err, ErrNotFound)
+	}
+	if value, err := db.GetTyped(key); err != ErrNotFound {
+		t.Errorf("GetTyped = %+v, %v, want %v", value, err, ErrNotFound)
+	}
+	if r, err := db.GetReader(key); err != ErrNotFound {
+		if r != nil {
+			r.Close()
+		}
+		t.Errorf("GetReader error = %v, want %v", err, ErrNotFound)
+	}
+	snap := db.Snapshot()
+	defer snap.Close()
+	if value, err := snap.Get(key); err != ErrNotFound {
+		t.Errorf("Snapshot.Get = %q, %v, want %v", value, err, ErrNotFound)
+	}
+	if value, err := team.Get("secret"); err != nil || value != "value" {
+		t.Errorf("team.Get = %q, %v", value, err)
+	}
+}
+
+func TestReservedKeys_OldData(t *testing.T) {
+	key := "\x00\x00\x00\x00\x01key"
+	record := entry{kind: kindPut, key: key, value: "value", seq: 1}
+	legacy := binary.LittleEndian.AppendUint32(nil, uint32(len(key)+5+12))
+	legacy = binary.LittleEndian.AppendUint32(legacy, uint32(len(key)))
+	legacy = append(legacy, key...)
+	legacy = binary.LittleEndian.AppendUint32(legacy, 5)
+	legacy = append(legacy, "value"...)
+
+	for name, data := range map[string][]byte{
+		"segment": append(encodeSegmentHeader(0), record.Encode()...),
+		"legacy":  legacy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// A default bucket key written before buckets existed.
+			tmp := t.TempDir()
+			if err := os.WriteFile(filepath.Join(tmp, segmentPrefix+"1"), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			db, err := Open(tmp)
+			if err == nil {
+				db.Close()
+			}
+			if !errors.Is(err, ErrReservedKey) {
+				t.Errorf("Open error = %v, want %v", err, ErrReservedKey)
+			}
+		})
+	}
+}
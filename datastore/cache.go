@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// CacheStats reports the state of the value cache.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	// Size is the number of bytes of keys and values held by the cache.
+	Size int64 `json:"size"`
+	Len  int   `json:"len"`
+}
+
+// valueCache is a least recently used cache of values bounded by the
+// total size of its keys and values. Reads run under db.mu read lock, so
+// the cache has its own lock; invalidations come with writes under db.mu.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type cacheItem struct {
+	key   string
+	value string
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return "", false
+	}
+	c.hits.Add(1)
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheItem).value, true
+}
+
+func (c *valueCache) add(key, value string) {
+	size := int64(len(key) + len(value))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(key)
+	c.items[key] = c.order.PushFront(&cacheItem{key: key, value: value})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeLocked(c.order.Back().Value.(*cacheItem).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *valueCache) removeLocked(key string) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	item := c.order.Remove(el).(*cacheItem)
+	delete(c.items, key)
+	c.size -= int64(len(item.key) + len(item.value))
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   c.size,
+		Len:    c.order.Len(),
+	}
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(12)
+	c.add("k1", "v1")
+	c.add("k2", "v2")
+	c.add("k3", "v3")
+	if _, ok := c.get("k1"); !ok {
+		t.Error("k1 is not cached")
+	}
+
+	// k2 is the least recently used now.
+	c.add("k4", "v4")
+	if _, ok := c.get("k2"); ok {
+		t.Error("k2 is not evicted")
+	}
+	for _, key := range []string{"k1", "k3", "k4"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s is not cached", key)
+		}
+	}
+
+	c.add("big", "value larger than the cache")
+	if _, ok := c.get("big"); ok {
+		t.Error("value larger than the cache is cached")
+	}
+
+	stats := c.stats()
+	if stats.Hits != 4 || stats.Misses != 2 {
+		t.Errorf("hits, misses = %d, %d; want 4, 2", stats.Hits, stats.Misses)
+	}
+	if stats.Len != 3 || stats.Size != 12 {
+		t.Errorf("len, size = %d, %d; want 3, 12", stats.Len, stats.Size)
+	}
+}
+
+func TestDbCache(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{CacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if value, err := db.Get("key"); err != nil || value != "v1" {
+			t.Errorf("Get(key) = %q, %v; want v1", value, err)
+		}
+	}
+	if stats := db.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("hits, misses = %d, %d; want 2, 1", stats.Hits, stats.Misses)
+	}
+
+	if err := db.Put("key", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "v2" {
+		t.Errorf("Get(key) after Put = %q, %v; want v2", value, err)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(key) after Delete error = %v; want ErrNotFound", err)
+	}
+	if stats := db.CacheStats(); stats.Len != 0 {
+		t.Errorf("cache holds %d values after Delete; want 0", stats.Len)
+	}
+}
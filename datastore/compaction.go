@@ -0,0 +1,334 @@
+package datastore
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// recordMove describes a live record found by a merge. When the record was
+// copied, to is its location in the merged segment, otherwise the record
+// is obsolete and its index entry is dropped. A deleted move is a
+// tombstone written to the merged segment.
+type recordMove struct {
+	key     string
+	from    recordLocation
+	to      recordLocation
+	deleted bool
+}
+
+// MergeSegments merges all closed segments into one and waits until the
+// merge is done.
+func (db *Db) MergeSegments() {
+	if err := db.compact(true); err != nil {
+		fmt.Printf("MergeSegments: %v\n", err)
+	}
+}
+
+// triggerCompaction asks the compaction goroutine to merge segments.
+// Triggers that come while a merge is pending are coalesced.
+func (db *Db) triggerCompaction() {
+	select {
+	case db.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+func (db *Db) runCompaction() {
+	for {
+		select {
+		case <-db.compactCh:
+			if err := db.compact(false); err != nil {
+				fmt.Printf("compaction: %v\n", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// compact merges the closed segments chosen by the merge policy, or all
+// of them. Live records are copied without holding the write lock, so
+// reads and writes go on during the merge; the index and the segment list
+// are switched to the merged segment in a short critical section at the
+// end.
+//
+// The merged segment takes the place of the newest merged one. When older
+// segments are left out of the merge, the tombstones of the merged ones
+// still shadow their records, so they are kept.
+func (db *Db) compact(all bool) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	db.mu.RLock()
+	closed := db.segments[:len(db.segments)-1]
+	oldSegments := slices.Clone(closed)
+	if !all {
+		oldSegments = db.opts.MergePolicy.selectSegments(closed)
+	}
+	keepTombstones := false
+	if len(oldSegments) > 0 {
+		newest := slices.Index(closed, oldSegments[len(oldSegments)-1])
+		keepTombstones = newest+1 > len(oldSegments)
+	}
+	db.mu.RUnlock()
+	if len(oldSegments) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := db.merge(oldSegments, keepTombstones)
+	db.mergeStats.record(time.Since(start), err)
+	return err
+}
+
+// merge copies the live records of oldSegments to a new segment and puts
+// it in their place. It must be called under db.compactMu.
+func (db *Db) merge(oldSegments []*segment, keepTombstones bool) error {
+	merged, err := db.newSegment(mergingPrefix + strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err != nil {
+		return fmt.Errorf("failed to create merged segment: %w", err)
+	}
+	discard := func(err error) error {
+		merged.Close()
+		if err := os.Remove(merged.path); err != nil {
+			fmt.Printf("compaction: failed to remove merged segment: %v\n", err)
+		}
+		return err
+	}
+
+	var moves []recordMove
+	now := db.clock().UnixNano()
+	for _, seg := range oldSegments {
+		segMoves, err := db.copyLiveRecords(&merged, seg, now, keepTombstones)
+		if err != nil {
+			return discard(fmt.Errorf("failed to copy live records from %s: %w", seg.path, err))
+		}
+		moves = append(moves, segMoves...)
+	}
+
+	if err := merged.Sync(); err != nil {
+		return discard(fmt.Errorf("failed to sync merged segment: %w", err))
+	}
+	if err := merged.Close(); err != nil {
+		return discard(fmt.Errorf("failed to close merged segment: %w", err))
+	}
+	empty := merged.size == segmentHeaderSize
+	if !empty {
+		if err := merged.rename(segmentPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)); err != nil {
+			return discard(fmt.Errorf("failed to rename merged segment: %w", err))
+		}
+	}
+
+	// The hint lists every record copied, the index decides which of them
+	// are still live.
+	keys := newSegmentKeys()
+	for _, mv := range moves {
+		switch {
+		case mv.to.segment == nil:
+		case mv.deleted:
+			keys.remove(mv.key, mv.to)
+		default:
+			keys.put(mv.key, mv.to)
+		}
+	}
+
+	if err := db.switchToMerged(merged, oldSegments, moves, empty); err != nil {
+		return discard(err)
+	}
+
+	if empty {
+		if err := os.Remove(merged.path); err != nil {
+			fmt.Printf("compaction: failed to remove empty merged segment: %v\n", err)
+		}
+		return nil
+	}
+	if err := writeHint(merged.segment, merged.size, keys, db.opts.FileMode); err != nil {
+		fmt.Printf("compaction: failed to write hint file: %v\n", err)
+	}
+	return nil
+}
+
+// switchToMerged puts the merged segment in place of oldSegments and points
+// the index at the moved records. The merged segment is opened for reads
+// before the manifest names it, so the merge is not committed unless its
+// records can be read.
+func (db *Db) switchToMerged(merged activeSegment, oldSegments []*segment, moves []recordMove, empty bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !empty {
+		if err := db.readers.open(merged.segment); err != nil {
+			return fmt.Errorf("failed to open merged segment for reads: %w", err)
+		}
+	}
+
+	// The merge takes effect once the manifest lists the merged segment in
+	// place of the old ones; until then a crash leaves the old ones in use.
+	newest := oldSegments[len(oldSegments)-1]
+	segments := make([]*segment, 0, len(db.segments))
+	for _, seg := range db.segments {
+		switch {
+		case seg == newest && !empty:
+			segments = append(segments, merged.segment)
+		case !slices.Contains(oldSegments, seg):
+			segments = append(segments, seg)
+		}
+	}
+	if err := db.saveManifest(segments); err != nil {
+		db.readers.close(merged.segment)
+		return err
+	}
+	db.segments = segments
+
+	for _, mv := range moves {
+		if loc, ok := db.index.get(mv.key); !ok || loc != mv.from {
+			// The record was overwritten while it was being copied.
+			if mv.to.segment != nil && !mv.deleted {
+				merged.dead += mv.to.size
+			}
+			continue
+		}
+		if mv.to.segment != nil && !mv.deleted {
+			db.index.set(mv.key, mv.to)
+		} else {
+			db.index.delete(mv.key)
+			if db.cache != nil {
+				db.cache.remove(mv.key)
+			}
+		}
+	}
+
+	for _, seg := range oldSegments {
+		db.retireSegment(seg)
+	}
+	if !empty {
+		db.readers.seal(merged.segment)
+	}
+	return nil
+}
+
+// copyLiveRecords appends the records of src that are still referenced by
+// the index to dst. With keepTombstones, the tombstones of deleted keys are
+// copied too and expired records are replaced with tombstones. The index
+// is only read-locked for each record check.
+func (db *Db) copyLiveRecords(dst *activeSegment, src *segment, now int64, keepTombstones bool) ([]recordMove, error) {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open old segment: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	if _, err := readSegmentHeader(reader); err != nil {
+		return nil, err
+	}
+	readOffset := int64(segmentHeaderSize)
+
+	var moves []recordMove
+	for {
+		var e entry
+		readed, err := e.DecodeFromReader(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from old segment: %w", err)
+		}
+
+		oldLoc := recordLocation{
+			segment:   src,
+			offset:    readOffset,
+			size:      int64(readed),
+			expiresAt: e.expiresAt,
+			seq:       e.seq,
+		}
+		readOffset += int64(readed)
+
+		if e.kind != kindPut && (e.kind != kindDelete || !keepTombstones) {
+			continue
+		}
+		key := e.indexKey()
+		db.mu.RLock()
+		loc, indexed := db.index.get(key)
+		_, inActive := db.activeSegment.index.get(key)
+		dropped := !db.buckets.has(e.bucket)
+		db.mu.RUnlock()
+		if dropped {
+			continue
+		}
+
+		mv := recordMove{key: key, from: oldLoc}
+		write := true
+		switch {
+		case e.kind == kindDelete:
+			// The tombstone is obsolete once the key is written again.
+			if indexed {
+				continue
+			}
+			mv.deleted = true
+		case loc != oldLoc:
+			continue
+		case inActive:
+			write = false
+		case e.expired(now):
+			// Segments left out of the merge may still hold the key.
+			e = entry{kind: kindDelete, key: e.key, seq: e.seq, bucket: e.bucket}
+			mv.deleted = true
+			write = keepTombstones
+		}
+
+		if write && e.kind == kindPut {
+			if err := db.recodeValue(&e, src, dst.segment); err != nil {
+				return nil, fmt.Errorf("offset %d: %w", oldLoc.offset, err)
+			}
+		}
+		if write {
+			writed, err := dst.Write(e.Encode())
+			if err != nil {
+				return nil, fmt.Errorf("failed to write to merged segment: %w", err)
+			}
+			mv.to = recordLocation{
+				segment:   dst.segment,
+				offset:    dst.size,
+				size:      int64(writed),
+				expiresAt: e.expiresAt,
+				seq:       e.seq,
+			}
+			dst.size += int64(writed)
+		}
+		moves = append(moves, mv)
+	}
+
+	return moves, nil
+}
+
+// recodeValue prepares the value of a record copied by a merge from src to
+// dst: it is decrypted with the key of src, compressed when the policy asks
+// for it and encrypted with the current key of dst.
+func (db *Db) recodeValue(e *entry, src, dst *segment) error {
+	compress := db.opts.Compression != CompressionNone
+	if src.keyID == dst.keyID && (!compress || e.compressed) {
+		return nil
+	}
+	if src.keyID != 0 {
+		if err := e.decrypt(db.ciphers[src.keyID]); err != nil {
+			return err
+		}
+	}
+	if compress {
+		e.compress(flate.DefaultCompression, db.opts.MinCompressSize)
+	}
+	if dst.keyID != 0 {
+		return e.encrypt(db.ciphers[dst.keyID])
+	}
+	return nil
+}
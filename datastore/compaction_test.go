@@ -0,0 +1,245 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompactionConcurrentWrites(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 512}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, rounds, keys = 4, 50, 20
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rounds {
+				key := fmt.Sprintf("w%d-key%d", w, r%keys)
+				if err := db.Put(key, fmt.Sprintf("value%d", r)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				if r%7 == 0 {
+					if err := db.Delete(key); err != nil {
+						t.Errorf("Delete failed: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 10 {
+			db.MergeSegments()
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	expected := make(map[string]string)
+	for w := range writers {
+		for r := range rounds {
+			key := fmt.Sprintf("w%d-key%d", w, r%keys)
+			expected[key] = fmt.Sprintf("value%d", r)
+			if r%7 == 0 {
+				delete(expected, key)
+			}
+		}
+	}
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		all, err := db.Scan("", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != len(expected) {
+			t.Errorf("Db has %d keys; want %d", len(all), len(expected))
+		}
+		for _, kv := range all {
+			if expected[kv.Key] != kv.Value {
+				t.Errorf("%s = %q; want %q", kv.Key, kv.Value, expected[kv.Key])
+			}
+		}
+	}
+	check(t, db)
+
+	db.MergeSegments()
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+}
+
+func TestMergePolicy_SelectSegments(t *testing.T) {
+	seg := func(records, dead int64) *segment {
+		return &segment{size: segmentHeaderSize + records, dead: dead}
+	}
+	var (
+		big     = seg(1000, 100)
+		garbage = seg(1000, 600)
+		small1  = seg(50, 0)
+		small2  = seg(80, 10)
+	)
+	p := MergePolicy{GarbageRatio: 0.5, SmallSegmentSize: 100}
+
+	tests := []struct {
+		name   string
+		policy MergePolicy
+		closed []*segment
+		want   []*segment
+	}{
+		{"mostly live", p, []*segment{big, big}, nil},
+		{"garbage", p, []*segment{big, garbage, big}, []*segment{garbage}},
+		{"small together", p, []*segment{small1, big, small2}, []*segment{small1, small2}},
+		{"lone small", p, []*segment{big, small1}, nil},
+		{"max merge size", MergePolicy{GarbageRatio: 0.5, SmallSegmentSize: 100, MaxMergeSize: 450},
+			[]*segment{garbage, small1, garbage}, []*segment{garbage, small1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.selectSegments(tt.closed)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("selectSegments() selected %d segments; want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func rotate(t *testing.T, db *Db) {
+	t.Helper()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.initNextSegment(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeadBytes(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate(t, db)
+	if err := db.Put("k1", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := entry{kind: kindPut, key: "k1", value: "value", seq: 1}
+	record := int64(len(e.Encode()))
+	first := db.segments[0]
+	if first.dead != 2*record {
+		t.Errorf("dead bytes = %d; want %d", first.dead, 2*record)
+	}
+	if first.liveBytes() != record {
+		t.Errorf("live bytes = %d; want %d", first.liveBytes(), record)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.segments[0].dead != 2*record {
+		t.Errorf("dead bytes after reopen = %d; want %d", db.segments[0].dead, 2*record)
+	}
+	if active := db.segments[1]; active.dead != 0 {
+		t.Errorf("active segment dead bytes after reopen = %d; want 0", active.dead)
+	}
+}
+
+func TestPartialMergeKeepsTombstones(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{MergePolicy: MergePolicy{MinSegments: -1, SmallSegmentSize: 1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"deleted", "expired", "live1", "live2", "live3", "live4", "live5"} {
+		if err := db.Put(key, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate(t, db)
+	if err := db.Delete("deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("expired", "new", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if err := db.Put("hot", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate(t, db)
+
+	first := db.segments[0].path
+	now := time.Now()
+	db.clock = func() time.Time { return now.Add(time.Hour) }
+	if err := db.compact(false); err != nil {
+		t.Fatal(err)
+	}
+	if db.segments[0].path != first {
+		t.Errorf("mostly live segment was merged")
+	}
+	if len(db.segments) != 3 {
+		t.Errorf("Db has %d segments after merge; want 3", len(db.segments))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"deleted", "expired"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) error = %v; want ErrNotFound", key, err)
+		}
+	}
+	if value, err := db.Get("hot"); err != nil || value != "value9" {
+		t.Errorf("Get(hot) = %q, %v; want value9", value, err)
+	}
+	if value, err := db.Get("live1"); err != nil || value != "old" {
+		t.Errorf("Get(live1) = %q, %v; want old", value, err)
+	}
+}
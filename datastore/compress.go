@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compression decides when values are stored compressed. Every record
+// says whether its value is compressed, so segments with both kinds of
+// records stay readable whatever the setting.
+type Compression int
+
+const (
+	// CompressionNone stores values as they are.
+	CompressionNone Compression = iota
+	// CompressionOnPut compresses values when they are written.
+	CompressionOnPut
+	// CompressionOnMerge writes values as they are and compresses them
+	// when segments are merged, keeping the write path cheap.
+	CompressionOnMerge
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone:    "none",
+	CompressionOnPut:   "put",
+	CompressionOnMerge: "merge",
+}
+
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// Set parses the compression name, so Compression can be used as a
+// flag.Value.
+func (c *Compression) Set(name string) error {
+	for compression, compressionName := range compressionNames {
+		if compressionName == name {
+			*c = compression
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compression %q", name)
+}
+
+// compress replaces the value of e with its compressed form when the
+// value is at least minSize bytes long and compression makes it smaller.
+func (e *entry) compress(level int, minSize int64) {
+	if e.compressed || int64(len(e.value)) < minSize {
+		return
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return
+	}
+	if _, err := io.Copy(w, strings.NewReader(e.value)); err != nil {
+		return
+	}
+	if err := w.Close(); err != nil {
+		return
+	}
+	if buf.Len() < len(e.value) {
+		e.value, e.compressed = buf.String(), true
+	}
+}
+
+// decompress replaces the compressed value of e with the original one.
+func (e *entry) decompress() error {
+	if !e.compressed {
+		return nil
+	}
+	value, err := io.ReadAll(flate.NewReader(strings.NewReader(e.value)))
+	if err != nil {
+		return fmt.Errorf("%w: cannot decompress value: %v", ErrCorrupted, err)
+	}
+	e.value, e.compressed = string(value), false
+	return nil
+}
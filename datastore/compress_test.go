@@ -0,0 +1,139 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	tmp := t.TempDir()
+	value := strings.Repeat(`{"team":"faang","date":"2025-01-01"}`, 100)
+
+	db, err := OpenWithOptions(tmp, Options{Compression: CompressionNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Compression: CompressionOnPut, MinCompressSize: 64}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("compressed", value); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("short", "short value"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.RLock()
+	plain, _ := db.lookup("plain")
+	compressed, _ := db.lookup("compressed")
+	db.mu.RUnlock()
+	if compressed.size >= plain.size/4 {
+		t.Errorf("compressed record takes %d bytes, plain one %d", compressed.size, plain.size)
+	}
+
+	for _, key := range []string{"plain", "compressed"} {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Get(%q) returned a different value, error %v", key, err)
+		}
+		r, err := db.GetReader(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != value {
+			t.Errorf("GetReader(%q) returned a different value, error %v", key, err)
+		}
+	}
+	if got, err := db.Get("short"); err != nil || got != "short value" {
+		t.Errorf("Get(short) = %q, %v; want short value", got, err)
+	}
+}
+
+func TestCompressionOnMerge(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{
+		SegmentSize:     4096,
+		Compression:     CompressionOnMerge,
+		MinCompressSize: 64,
+		MergePolicy:     MergePolicy{MinSegments: -1},
+	}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("compressible ", 100)
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sizeBefore, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.MergeSegments()
+	sizeAfter, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizeAfter >= sizeBefore/2 {
+		t.Errorf("Size after merge = %d; want less than half of %d", sizeAfter, sizeBefore)
+	}
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Get(%q) returned a different value, error %v", key, err)
+		}
+	}
+}
+
+func TestCompression_Corrupted(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{Compression: CompressionOnPut, MinCompressSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", strings.Repeat("value", 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.RLock()
+	loc, _ := db.lookup("key")
+	db.mu.RUnlock()
+	f, err := os.OpenFile(loc.segment.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff}, loc.offset+loc.size-8); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err := db.GetReader("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("reading a corrupted compressed value error = %v; want ErrCorrupted", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Get of a corrupted compressed value error = %v; want ErrCorrupted", err)
+	}
+}
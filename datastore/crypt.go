@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// Keyring holds the AES keys of a Db. New segments are encrypted with the
+// current key and merges re-encrypt live values with it; older keys are
+// kept to read segments written before a rotation. Every segment records
+// the ID of its key in the header.
+//
+// Only the values of put records are sealed with AES-GCM. Keys, expiry
+// times and sequence numbers are stored in the clear in the segments and
+// in the hint files, so keys must not hold secrets when the data has to
+// be protected at rest. The records of deleted keys and backup archives
+// expose keys in the same way.
+type Keyring struct {
+	// Current is the ID of the key that encrypts new segments. Zero
+	// leaves new segments unencrypted.
+	Current uint16
+	// Keys maps key IDs to AES keys of 16, 24 or 32 bytes. ID zero is
+	// reserved for unencrypted segments.
+	Keys map[uint16][]byte
+}
+
+func (k Keyring) ciphers() (map[uint16]cipher.AEAD, error) {
+	res := make(map[uint16]cipher.AEAD, len(k.Keys))
+	for id, key := range k.Keys {
+		if id == 0 {
+			return nil, fmt.Errorf("key ID 0 is reserved")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		res[id] = aead
+	}
+	if _, ok := res[k.Current]; k.Current != 0 && !ok {
+		return nil, fmt.Errorf("current key %d is not in the keyring", k.Current)
+	}
+	return res, nil
+}
+
+// encrypt seals the value of e with a random nonce put in front of it.
+// The record key and its bucket are authenticated too, so a value cannot
+// be moved to another key.
+func (e *entry) encrypt(aead cipher.AEAD) error {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(e.value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	e.value = string(aead.Seal(nonce, nonce, []byte(e.value), []byte(e.indexKey())))
+	return nil
+}
+
+func (e *entry) decrypt(aead cipher.AEAD) error {
+	if len(e.value) < aead.NonceSize() {
+		return fmt.Errorf("%w: encrypted value is too short", ErrCorrupted)
+	}
+	sealed := []byte(e.value)
+	value, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(e.indexKey()))
+	if err != nil {
+		return fmt.Errorf("%w: cannot decrypt value: %v", ErrCorrupted, err)
+	}
+	e.value = string(value)
+	return nil
+}
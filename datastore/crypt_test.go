@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryption(t *testing.T) {
+	tmp := t.TempDir()
+	key1 := Keyring{Current: 1, Keys: map[uint16][]byte{1: testKey(1)}}
+	opts := Options{SegmentSize: 256, Keyring: key1, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "secret-value-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("counter", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range segmentFiles(t, tmp) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret-value")) {
+			t.Errorf("Segment %s holds a value in the clear", path)
+		}
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, err := OpenWithOptions(tmp, Options{}); err == nil {
+			t.Error("Open without the key succeeded")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		wrong := opts
+		wrong.Keyring = Keyring{Current: 1, Keys: map[uint16][]byte{1: testKey(9)}}
+		db, err := OpenWithOptions(tmp, wrong)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Get("k1"); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Get with a wrong key error = %v; want ErrCorrupted", err)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		rotated := opts
+		rotated.Keyring = Keyring{Current: 2, Keys: map[uint16][]byte{1: testKey(1), 2: testKey(2)}}
+		db, err := OpenWithOptions(tmp, rotated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("k2", "secret-value-2"); err != nil {
+			t.Fatal(err)
+		}
+		if active := db.activeSegment.keyID; active != 2 {
+			t.Errorf("Active segment key = %d; want 2", active)
+		}
+		db.MergeSegments()
+		for _, seg := range db.segments {
+			if seg.keyID != 2 {
+				t.Errorf("Segment %s key = %d after merge; want 2", seg.path, seg.keyID)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The old key is not needed anymore.
+		rotated.Keyring = Keyring{Current: 2, Keys: map[uint16][]byte{2: testKey(2)}}
+		db, err = OpenWithOptions(tmp, rotated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for k, want := range map[string]string{"k1": "secret-value-1", "k2": "secret-value-2", "counter": "7"} {
+			if got, err := db.Get(k); err != nil || got != want {
+				t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, want)
+			}
+		}
+	})
+}
+
+func TestEncryption_FromPlain(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "plain-value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{Keyring: Keyring{Current: 1, Keys: map[uint16][]byte{1: testKey(1)}}}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("key"); err != nil || got != "plain-value" {
+		t.Errorf("Get(key) = %q, %v; want plain-value", got, err)
+	}
+
+	db.MergeSegments()
+	db.mu.RLock()
+	loc, _ := db.lookup("key")
+	db.mu.RUnlock()
+	if loc.segment.keyID != 1 {
+		t.Errorf("Value is in a segment with key %d after merge; want 1", loc.segment.keyID)
+	}
+	if got, err := db.Get("key"); err != nil || got != "plain-value" {
+		t.Errorf("Get(key) after merge = %q, %v; want plain-value", got, err)
+	}
+}
@@ -1,147 +1,719 @@
 package datastore
 
 import (
+	"compress/flate"
+	"crypto/cipher"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	segmentPrefix = "segment-"
+	retiredPrefix = "retired-"
+	mergingPrefix = "merging-"
+	spoolPrefix   = "spool-"
 )
 
 var (
-	SegmentSizeLimit = int64(10 * 1024 * 1024)
+	ErrNotFound        = errors.New("record does not exist")
+	ErrVersionMismatch = errors.New("version mismatch")
+	ErrReadOnly        = errors.New("database is opened read-only")
 )
 
-var ErrNotFound = errors.New("record does not exist")
-
 type hashIndex map[string]recordLocation
 
 type recordLocation struct {
-	segment *segment
-	offset  int64
+	segment   *segment
+	offset    int64
+	size      int64
+	expiresAt int64
+	seq       uint64
+}
+
+func (loc recordLocation) expired(now int64) bool {
+	return loc.expiresAt != 0 && loc.expiresAt <= now
 }
 
 type Db struct {
 	dir           string
+	opts          Options
 	activeSegment activeSegment
 	mu            sync.RWMutex
 	segments      []*segment
-	index         hashIndex
-	rw            readWorkers
+	index         *keyIndex
+	readers       segmentReaders
+	ciphers       map[uint16]cipher.AEAD
+	readSem       chan struct{}
+	cache         *valueCache
+	syncer        *syncer
+	compactMu     sync.Mutex
+	compactCh     chan struct{}
+	done          chan struct{}
+	wg            sync.WaitGroup
+	clock         func() time.Time
+	syncFile      func(*os.File) error
+	lastSeq       uint64
+	mergeStats    mergeStats
+	reads         atomic.Uint64
+	writes        atomic.Uint64
+	lock          *os.File
+	readOnly      bool
+	watchers      map[*watcher]struct{}
+	buckets       bucketRegistry
 }
 
+// Open opens the database in dir with DefaultOptions.
 func Open(dir string) (*Db, error) {
+	return OpenWithOptions(dir, DefaultOptions())
+}
+
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, false)
+}
+
+// OpenReadOnly opens the database in dir for reads only. It works next to
+// a writer, even a running one, and sees the database as of the moment it
+// was opened: later writes and merges of the writer are not picked up. It
+// leaves the segments as they are and fails every write with ErrReadOnly.
+func OpenReadOnly(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, true)
+}
+
+// readOnlyLoadAttempts bounds how many times a read-only open loads the
+// directory again after a merge of the writer removed a segment it was
+// loading.
+const readOnlyLoadAttempts = 3
+
+func open(dir string, opts Options, readOnly bool) (*Db, error) {
+	opts = opts.withDefaults()
+	ciphers, err := opts.Keyring.ciphers()
+	if err != nil {
+		return nil, fmt.Errorf("bad keyring: %w", err)
+	}
+
+	var lock *os.File
+	if !readOnly {
+		if err := os.MkdirAll(dir, opts.DirMode); err != nil {
+			return nil, err
+		}
+		if lock, err = lockDir(dir, opts.FileMode); err != nil {
+			return nil, err
+		}
+	}
+
+	var db *Db
+	for attempt := 1; ; attempt++ {
+		db = newDb(dir, opts, ciphers, readOnly)
+		err = db.lockAndLoad()
+		if err == nil {
+			break
+		}
+		db.readers.closeAll()
+		if db.activeSegment.File != nil {
+			db.activeSegment.Close()
+		}
+		if !readOnly || !errors.Is(err, os.ErrNotExist) || attempt == readOnlyLoadAttempts {
+			if lock != nil {
+				lock.Close()
+			}
+			return nil, err
+		}
+	}
+	db.lock = lock
+	if readOnly {
+		return db, nil
+	}
+
+	if opts.SyncPolicy == SyncPeriodic {
+		db.wg.Add(1)
+		go func() {
+			defer db.wg.Done()
+			db.runPeriodicSync(opts.SyncInterval)
+		}()
+	}
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		db.runCompaction()
+	}()
+
+	return db, nil
+}
+
+func newDb(dir string, opts Options, ciphers map[uint16]cipher.AEAD, readOnly bool) *Db {
 	db := &Db{
-		dir:      dir,
-		segments: []*segment{},
-		index:    make(hashIndex),
-		rw:       newReadWorkers(),
+		dir:       dir,
+		opts:      opts,
+		segments:  []*segment{},
+		index:     newKeyIndex(),
+		readers:   newSegmentReaders(opts.MmapReads, ciphers),
+		ciphers:   ciphers,
+		syncer:    newSyncer(),
+		compactCh: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		clock:     time.Now,
+		syncFile:  (*os.File).Sync,
+		readOnly:  readOnly,
+		watchers:  make(map[*watcher]struct{}),
+		buckets:   newBucketRegistry(),
+	}
+	if opts.ReadConcurrency > 0 {
+		db.readSem = make(chan struct{}, opts.ReadConcurrency)
+	}
+	if opts.CacheSize > 0 {
+		db.cache = newValueCache(opts.CacheSize)
 	}
+	return db
+}
 
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, err
+// lockAndLoad loads the directory under the load lock.
+func (db *Db) lockAndLoad() error {
+	lock, err := lockLoad(db.dir, db.readOnly, db.opts.FileMode)
+	if err != nil {
+		return err
 	}
+	defer lock.Close()
+	return db.load()
+}
 
+// load loads the segments listed by the manifest and builds the index.
+// Unless the database is read-only, it also cleans up after a crash and
+// opens the active segment.
+func (db *Db) load() error {
+	dir := db.dir
 	files, err := os.ReadDir(dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
+	var segmentFiles []string
 	for _, file := range files {
 		name := file.Name()
-		if !strings.HasPrefix(name, segmentPrefix) {
+		if strings.HasPrefix(name, retiredPrefix) || strings.HasPrefix(name, mergingPrefix) ||
+			strings.HasPrefix(name, spoolPrefix) || name == manifestName+manifestTempSuffix {
+			if db.readOnly {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
 			continue
 		}
+		if strings.HasPrefix(name, segmentPrefix) {
+			segmentFiles = append(segmentFiles, name)
+		}
+	}
+
+	// A directory without a manifest predates it, its segments are ordered
+	// by their names.
+	m, err := readManifest(dir)
+	names := m.names
+	noManifest := errors.Is(err, os.ErrNotExist)
+	switch {
+	case noManifest:
+		for _, name := range segmentFiles {
+			if !strings.HasSuffix(name, hintSuffix) {
+				names = append(names, name)
+			}
+		}
+		if err := db.convertLegacySegments(names); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		db.buckets = m.buckets
+		db.lastSeq = m.lastSeq
+		if !db.readOnly {
+			if err := removeOrphans(dir, segmentFiles, names); err != nil {
+				return err
+			}
+		}
+	}
 
+	var (
+		lastKeys   segmentKeys
+		tombstones []hashIndex
+	)
+	for i, name := range names {
 		path := filepath.Join(db.dir, name)
-		err := db.recoverSegment(path)
+		last := i == len(names)-1
+		_, keys, err := db.recoverSegment(path, last)
 		if err != nil {
-			return nil, fmt.Errorf("failed to recover %s: %w", name, err)
+			return fmt.Errorf("failed to recover %s: %w", name, err)
+		}
+		db.dropUnknownBuckets(keys)
+
+		for key, loc := range keys.deleted {
+			db.index.delete(key)
+			db.lastSeq = max(db.lastSeq, loc.seq)
+		}
+		tombstones = append(tombstones, keys.deleted)
+		for _, loc := range keys.index.all() {
+			db.lastSeq = max(db.lastSeq, loc.seq)
+		}
+		if last {
+			lastKeys = keys
+		} else {
+			for key, loc := range keys.index.all() {
+				db.index.set(key, loc)
+			}
 		}
 	}
 
-	if len(db.segments) > 0 {
+	switch {
+	case db.readOnly:
+		if len(db.segments) == 0 {
+			return fmt.Errorf("no segments in %s", dir)
+		}
+		// The last segment is indexed as the active one but never written.
+		db.activeSegment = activeSegment{
+			segment:     db.segments[len(db.segments)-1],
+			segmentKeys: lastKeys,
+		}
+	case len(db.segments) > 0:
 		last := db.segments[len(db.segments)-1]
-		active, err := last.activate()
+		active, err := last.activate(db.opts.FileMode, db.opts.Keyring.Current)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		active.segmentKeys = lastKeys
 		db.activeSegment = active
-	} else {
+		if err := db.syncer.setFile(active.File); err != nil {
+			return err
+		}
+		if noManifest {
+			if err := db.saveManifest(db.segments); err != nil {
+				return err
+			}
+		}
+		// New records go to a segment encrypted with the current key.
+		if active.keyID != db.opts.Keyring.Current {
+			if err := db.initNextSegment(); err != nil {
+				return err
+			}
+		}
+	default:
 		if err := db.initNextSegment(); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return db, nil
+	db.countDeadBytes(tombstones)
+	return nil
+}
+
+// convertLegacySegments converts the segments in the format that predates
+// segment headers, numbering their records in the order of names.
+func (db *Db) convertLegacySegments(names []string) error {
+	var seq uint64
+	for _, name := range names {
+		path := filepath.Join(db.dir, name)
+		legacy, err := isLegacySegment(path)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			continue
+		}
+		if db.readOnly {
+			return fmt.Errorf("%s: %w", name, errLegacySegment)
+		}
+		if seq, err = convertLegacySegment(path, seq, db.opts.FileMode); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// removeOrphans deletes the segment and hint files that are not listed in
+// the manifest: leftovers of a rotation or a merge interrupted by a crash.
+func removeOrphans(dir string, files, live []string) error {
+	for _, name := range files {
+		if slices.Contains(live, strings.TrimSuffix(name, hintSuffix)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		fmt.Printf("Open: removed orphaned file %s\n", name)
+	}
+	return nil
+}
+
+// countDeadBytes sets the dead bytes of the recovered segments: everything
+// except indexed records and tombstones of keys that are still deleted.
+func (db *Db) countDeadBytes(tombstones []hashIndex) {
+	live := make(map[*segment]int64, len(db.segments))
+	for key, loc := range db.index.all() {
+		if _, inActive := db.activeSegment.index.get(key); !inActive {
+			live[loc.segment] += loc.size
+		}
+	}
+	for _, loc := range db.activeSegment.index.all() {
+		live[loc.segment] += loc.size
+	}
+	for _, deleted := range tombstones {
+		for key, loc := range deleted {
+			_, inActive := db.activeSegment.index.get(key)
+			if _, ok := db.index.get(key); !ok && !inActive {
+				live[loc.segment] += loc.size
+			}
+		}
+	}
+
+	for _, seg := range db.segments {
+		seg.dead = seg.size - segmentHeaderSize - live[seg]
+	}
 }
 
 func (db *Db) Close() error {
+	close(db.done)
+	if db.lock != nil {
+		defer db.lock.Close()
+	}
+	db.wg.Wait()
 	db.mu.Lock()
-	db.rw.clear()
+	db.readers.closeAll()
+	if db.readOnly {
+		return nil
+	}
+	if err := db.syncer.flush(); err != nil {
+		db.activeSegment.Close()
+		return err
+	}
 	return db.activeSegment.Close()
 }
 
 func (db *Db) Get(key string) (string, error) {
+	if reservedKey(key) {
+		return "", ErrNotFound
+	}
+	return db.get(key)
+}
+
+// get reads the value of an index key.
+func (db *Db) get(key string) (string, error) {
+	if db.readSem != nil {
+		db.readSem <- struct{}{}
+		defer func() { <-db.readSem }()
+	}
+
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	var loc recordLocation
+	db.reads.Add(1)
+	loc, ok := db.lookup(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return db.readValue(key, loc)
+}
 
-	offset, ok := db.activeSegment.index[key]
-	if ok {
-		loc = recordLocation{
-			segment: db.activeSegment.segment,
-			offset:  offset,
-		}
-	} else {
-		loc, ok = db.index[key]
-		if !ok {
-			return "", ErrNotFound
-		}
+// readValue reads the value of key stored at loc, going through the value
+// cache when it is enabled. It must be called under db.mu.
+func (db *Db) readValue(key string, loc recordLocation) (string, error) {
+	if db.cache == nil {
+		return db.readers.get(loc)
+	}
+	if value, ok := db.cache.get(key); ok {
+		return value, nil
 	}
+	value, err := db.readers.get(loc)
+	if err != nil {
+		return "", err
+	}
+	db.cache.add(key, value)
+	return value, nil
+}
+
+// CacheStats returns the counters of the value cache. They are zero when
+// the cache is disabled.
+func (db *Db) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
 
-	return db.rw.get(loc)
+// lookup finds the latest unexpired record of key. It must be called
+// under db.mu.
+func (db *Db) lookup(key string) (recordLocation, bool) {
+	loc, ok := db.activeSegment.index.get(key)
+	if !ok {
+		loc, ok = db.index.get(key)
+	}
+	if !ok || loc.expired(db.clock().UnixNano()) {
+		return recordLocation{}, false
+	}
+	return loc, true
 }
 
 func (db *Db) Put(key, value string) error {
-	db.mu.Lock()
+	return db.write(entry{
+		kind:  kindPut,
+		key:   key,
+		value: value,
+	})
+}
 
-	e := entry{
+// PutWithTTL stores the value that expires after ttl. Expired keys are
+// reported as missing and dropped by the next merge.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	return db.write(entry{
+		kind:      kindPut,
+		key:       key,
+		value:     value,
+		expiresAt: db.clock().Add(ttl).UnixNano(),
+	})
+}
+
+func (db *Db) Delete(key string) error {
+	return db.delete(entry{
+		kind: kindDelete,
+		key:  key,
+	})
+}
+
+// delete writes the tombstone e of a key that must exist.
+func (db *Db) delete(e entry) error {
+	_, err := db.writeIf(func() error {
+		if _, ok := db.lookup(e.indexKey()); !ok {
+			return ErrNotFound
+		}
+		return nil
+	}, e)
+	return err
+}
+
+// GetWithVersion returns the value of key together with its version, the
+// sequence number of the write that stored it.
+func (db *Db) GetWithVersion(key string) (string, uint64, error) {
+	if reservedKey(key) {
+		return "", 0, ErrNotFound
+	}
+	if db.readSem != nil {
+		db.readSem <- struct{}{}
+		defer func() { <-db.readSem }()
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.reads.Add(1)
+	loc, ok := db.lookup(key)
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+	value, err := db.readValue(key, loc)
+	if err != nil {
+		return "", 0, err
+	}
+	return value, loc.seq, nil
+}
+
+// CompareAndSwap stores the value only if the current version of key is
+// expectedVersion, zero meaning that the key must not exist. It returns
+// the new version or ErrVersionMismatch.
+func (db *Db) CompareAndSwap(key string, expectedVersion uint64, value string) (uint64, error) {
+	return db.writeIf(func() error {
+		var version uint64
+		if loc, ok := db.lookup(key); ok {
+			version = loc.seq
+		}
+		if version != expectedVersion {
+			return ErrVersionMismatch
+		}
+		return nil
+	}, entry{
+		kind:  kindPut,
 		key:   key,
 		value: value,
+	})
+}
+
+// write appends the records to the active segment with a single write
+// call, so they are never split between two segments.
+func (db *Db) write(entries ...entry) error {
+	_, err := db.writeIf(nil, entries...)
+	return err
+}
+
+// writeIf is write that first checks cond under the write lock and
+// aborts with its error. It returns the sequence number of the last
+// written record.
+func (db *Db) writeIf(cond func() error, entries ...entry) (uint64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	for i := range entries {
+		e := &entries[i]
+		if e.kind == kindPut || e.kind == kindDelete {
+			if err := db.checkSize(e.key, int64(len(e.value))); err != nil {
+				return 0, err
+			}
+			if e.bucket == 0 && reservedKey(e.key) {
+				return 0, ErrReservedKey
+			}
+		}
+		if e.kind == kindPut && db.opts.Compression == CompressionOnPut {
+			e.compress(flate.BestSpeed, db.opts.MinCompressSize)
+		}
 	}
-	data := e.Encode()
 
-	if db.activeSegment.size+int64(len(data)) > SegmentSizeLimit {
-		db.activeSegment.Close()
-		if err := db.initNextSegment(); err != nil {
+	db.mu.Lock()
+
+	if cond != nil {
+		if err := cond(); err != nil {
 			db.mu.Unlock()
-			return err
+			return 0, err
+		}
+	}
+	// The bucket may be dropped after the writer looked its ID up.
+	for _, e := range entries {
+		if !db.buckets.has(e.bucket) {
+			db.mu.Unlock()
+			return 0, ErrNoBucket
+		}
+	}
+
+	var (
+		data    []byte
+		changes []entry
+	)
+	sizes := make([]int64, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		if e.kind == kindPut || e.kind == kindDelete {
+			db.lastSeq++
+			e.seq = db.lastSeq
+		}
+		if len(db.watchers) > 0 {
+			changes = append(changes, *e)
+		}
+		if e.kind == kindPut && db.opts.Keyring.Current != 0 {
+			if err := e.encrypt(db.ciphers[db.opts.Keyring.Current]); err != nil {
+				db.mu.Unlock()
+				return 0, err
+			}
 		}
+		encoded := e.Encode()
+		sizes[i] = int64(len(encoded))
+		data = append(data, encoded...)
 	}
 
-	n, err := db.activeSegment.Write(data)
+	syncSeq, err := db.appendRecords(int64(len(data)), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
 	if err != nil {
 		db.mu.Unlock()
-		return err
+		return 0, err
 	}
+	db.indexRecords(entries, sizes)
+	db.notify(changes)
+	return db.finishWrite(syncSeq)
+}
 
-	db.activeSegment.index[key] = db.activeSegment.size
-	db.activeSegment.size += int64(n)
+func (db *Db) checkSize(key string, valueSize int64) error {
+	return checkSize(int64(len(key)), valueSize, db.opts.MaxKeySize, db.opts.MaxValueSize)
+}
 
-	if len(db.segments) >= 3 {
-		go db.lockMergeSegments()
-	} else {
-		db.mu.Unlock()
+// appendRecords writes size bytes of records to the active segment with
+// write, starting a new segment first when they do not fit. A failed
+// write is cut off the segment, so no partial record is left behind. It
+// must be called under db.mu.
+func (db *Db) appendRecords(size int64, write func(w io.Writer) error) (uint64, error) {
+	if db.activeSegment.size > segmentHeaderSize &&
+		db.activeSegment.size+size > db.opts.SegmentSize {
+		if err := db.initNextSegment(); err != nil {
+			return 0, err
+		}
 	}
 
-	return nil
+	if err := write(db.activeSegment.File); err != nil {
+		if err := db.activeSegment.Truncate(db.activeSegment.size); err != nil {
+			fmt.Printf("appendRecords: failed to cut off partial write: %v\n", err)
+		}
+		return 0, err
+	}
+	var syncSeq uint64
+	switch db.opts.SyncPolicy {
+	case SyncAlways:
+		if err := db.activeSegment.Sync(); err != nil {
+			return 0, err
+		}
+	case SyncGroup, SyncPeriodic:
+		syncSeq = db.syncer.add()
+	}
+	return syncSeq, nil
+}
+
+// indexRecords makes the records just appended to the active segment
+// visible. It must be called under db.mu.
+func (db *Db) indexRecords(entries []entry, sizes []int64) {
+	for i, e := range entries {
+		key := e.indexKey()
+		if e.kind == kindPut || e.kind == kindDelete {
+			if prev, ok := db.activeSegment.index.get(key); ok {
+				prev.segment.dead += prev.size
+			} else if prev, ok := db.index.get(key); ok {
+				prev.segment.dead += prev.size
+			}
+			if db.cache != nil {
+				db.cache.remove(key)
+			}
+		} else {
+			db.activeSegment.dead += sizes[i]
+		}
+
+		loc := recordLocation{
+			segment:   db.activeSegment.segment,
+			offset:    db.activeSegment.size,
+			size:      sizes[i],
+			expiresAt: e.expiresAt,
+			seq:       e.seq,
+		}
+		switch e.kind {
+		case kindPut:
+			db.activeSegment.put(key, loc)
+		case kindDelete:
+			db.activeSegment.remove(key, loc)
+			db.index.delete(key)
+		}
+		db.activeSegment.size += loc.size
+	}
+}
+
+// finishWrite releases db.mu taken by a write and waits until the write
+// is flushed when the sync policy asks for it. It returns the sequence
+// number of the last write.
+func (db *Db) finishWrite(syncSeq uint64) (uint64, error) {
+	seq := db.lastSeq
+	db.writes.Add(1)
+
+	if db.opts.MergePolicy.shouldMerge(db.segments) {
+		db.triggerCompaction()
+	}
+	db.mu.Unlock()
+
+	if db.opts.SyncPolicy == SyncGroup {
+		if err := db.syncer.wait(syncSeq); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
 }
 
 func (db *Db) Size() (int64, error) {
@@ -1,16 +1,21 @@
 package datastore
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDb(t *testing.T) {
 	tmp := t.TempDir()
-	SegmentSizeLimit = 1024
-	db, err := Open(tmp)
+	opts := Options{SegmentSize: 1024}
+	db, err := OpenWithOptions(tmp, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,7 +75,7 @@ func TestDb(t *testing.T) {
 		if err := db.Close(); err != nil {
 			t.Fatal(err)
 		}
-		db, err = Open(tmp)
+		db, err = OpenWithOptions(tmp, opts)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -94,8 +99,8 @@ func TestDb(t *testing.T) {
 
 func TestMergeSegments(t *testing.T) {
 	tmp := t.TempDir()
-	SegmentSizeLimit = 12
-	db, err := Open(tmp)
+	opts := Options{SegmentSize: 12}
+	db, err := OpenWithOptions(tmp, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,7 +138,7 @@ func TestMergeSegments(t *testing.T) {
 
 	segmentCount := 0
 	for _, f := range files {
-		if strings.HasPrefix(f.Name(), segmentPrefix) {
+		if strings.HasPrefix(f.Name(), segmentPrefix) && !strings.HasSuffix(f.Name(), hintSuffix) {
 			segmentCount++
 		}
 	}
@@ -142,3 +147,750 @@ func TestMergeSegments(t *testing.T) {
 		t.Errorf("Expected multiple segments, got %d", segmentCount)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 64}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 6 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	for _, key := range []string{"key0", "key5"} {
+		if err := db.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) failed: %v", key, err)
+		}
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Get(%q) after delete = %v; want ErrNotFound", key, err)
+		}
+	}
+	if err := db.Delete("missing"); err != ErrNotFound {
+		t.Errorf("Delete(missing) = %v; want ErrNotFound", err)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"key0", "key5"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Get(%q) after reopen = %v; want ErrNotFound", key, err)
+			}
+		}
+		if v, err := db.Get("key3"); err != nil || v != "value3" {
+			t.Errorf("Get(key3) = %q, %v; want value3", v, err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.MergeSegments()
+
+		for _, key := range []string{"key0", "key5"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Get(%q) after merge = %v; want ErrNotFound", key, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, err := db.Get("key0"); err != ErrNotFound {
+			t.Errorf("Get(key0) after merge and reopen = %v; want ErrNotFound", err)
+		}
+		if v, err := db.Get("key1"); err != nil || v != "value1" {
+			t.Errorf("Get(key1) = %q, %v; want value1", v, err)
+		}
+	})
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var paths []string
+	for _, name := range m.names {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 1024}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := segmentFiles(t, tmp)
+	last := segments[len(segments)-1]
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatalf("Open after torn write failed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("key2"); err != ErrNotFound {
+		t.Errorf("Get(key2) = %v; want ErrNotFound for the torn record", err)
+	}
+	if v, err := db.Get("key1"); err != nil || v != "value1" {
+		t.Errorf("Get(key1) = %q, %v; want value1", v, err)
+	}
+
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatalf("Put after recovery failed: %v", err)
+	}
+	if v, err := db.Get("key3"); err != nil || v != "value3" {
+		t.Errorf("Get(key3) = %q, %v; want value3", v, err)
+	}
+}
+
+func TestRecoverAfterPowerLoss(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 128, SyncPolicy: SyncNone, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Record how much of every segment was flushed to disk.
+	synced := make(map[string]int64)
+	db.syncFile = func(f *os.File) error {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		synced[f.Name()] = stat.Size()
+		return f.Sync()
+	}
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A power loss drops whatever was not synced; the closed segments
+	// must have been flushed on rotation.
+	segments := segmentFiles(t, tmp)
+	if len(segments) < 3 {
+		t.Fatalf("got %d segments, want rotations", len(segments))
+	}
+	for _, path := range segments[:len(segments)-1] {
+		if err := os.Truncate(path, synced[path]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatalf("Open after power loss: %v", err)
+	}
+	defer db.Close()
+	if got, err := db.Get("key0"); err != nil || got != "value0" {
+		t.Errorf("Get(key0) = %q, %v; want value0", got, err)
+	}
+}
+
+func TestRecoverCorruptedSegment(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 64}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := segmentFiles(t, tmp)
+	if len(segments) < 2 {
+		t.Fatalf("Expected multiple segments, got %d", len(segments))
+	}
+	data, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[segmentHeaderSize+entryHeaderSize] ^= 0xff
+	if err := os.WriteFile(segments[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(segments[0] + hintSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenWithOptions(tmp, opts); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Open with corrupted old segment = %v; want ErrCorrupted", err)
+	}
+}
+
+func TestHintFiles(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 64}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 4 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := db.Put("key4", "value4"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := segmentFiles(t, tmp)
+	for _, path := range segments[:len(segments)-1] {
+		if _, err := os.Stat(path + hintSuffix); err != nil {
+			t.Errorf("Closed segment %s has no hint file: %v", path, err)
+		}
+	}
+
+	expected := map[string]string{
+		"key0": "value0",
+		"key2": "value2",
+		"key3": "value3",
+		"key4": "value4",
+	}
+	check := func(t *testing.T) {
+		db, err := OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for k, v := range expected {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, v)
+			}
+		}
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Get(key1) = %v; want ErrNotFound", err)
+		}
+	}
+
+	t.Run("from hints", check)
+
+	t.Run("damaged hint", func(t *testing.T) {
+		for _, path := range segments[:len(segments)-1] {
+			if err := os.WriteFile(path+hintSuffix, []byte("garbage"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t)
+	})
+
+	t.Run("missing hint", func(t *testing.T) {
+		for _, path := range segments[:len(segments)-1] {
+			if err := os.Remove(path + hintSuffix); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(t)
+	})
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	small, err := OpenWithOptions(t.TempDir(), Options{
+		SegmentSize: 80,
+		MergePolicy: MergePolicy{MinSegments: -1},
+		FileMode:    0640,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+
+	large, err := OpenWithOptions(t.TempDir(), Options{SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer large.Close()
+
+	for i := range 10 {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := small.Put(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := large.Put(key, value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	if n := len(segmentFiles(t, small.dir)); n != 5 {
+		t.Errorf("Small db has %d segments; want 5 without merges", n)
+	}
+	if n := len(segmentFiles(t, large.dir)); n != 1 {
+		t.Errorf("Large db has %d segments; want 1", n)
+	}
+
+	for _, path := range segmentFiles(t, small.dir) {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0640 {
+			t.Errorf("Segment %s has mode %v; want 0640", path, perm)
+		}
+	}
+}
+
+func TestSyncPolicy_Set(t *testing.T) {
+	var p SyncPolicy
+	if err := p.Set("always"); err != nil || p != SyncAlways {
+		t.Errorf("Set(always) = %v, %v; want SyncAlways", p, err)
+	}
+	if err := p.Set("group"); err != nil || p != SyncGroup {
+		t.Errorf("Set(group) = %v, %v; want SyncGroup", p, err)
+	}
+	if err := p.Set("sometimes"); err == nil {
+		t.Error("Set(sometimes) must fail")
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncNone, SyncAlways, SyncGroup, SyncPeriodic} {
+		t.Run(policy.String(), func(t *testing.T) {
+			tmp := t.TempDir()
+			opts := Options{
+				SegmentSize:  256,
+				SyncPolicy:   policy,
+				SyncInterval: time.Millisecond,
+			}
+			db, err := OpenWithOptions(tmp, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			for w := range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range 10 {
+						if err := db.Put(fmt.Sprintf("key%d-%d", w, i), fmt.Sprintf("value%d", i)); err != nil {
+							t.Errorf("Put failed: %v", err)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWithOptions(tmp, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for w := range 4 {
+				for i := range 10 {
+					key := fmt.Sprintf("key%d-%d", w, i)
+					if v, err := db.Get(key); err != nil || v != fmt.Sprintf("value%d", i) {
+						t.Errorf("Get(%q) = %q, %v; want value%d", key, v, err, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, policy := range []SyncPolicy{SyncNone, SyncAlways, SyncGroup, SyncPeriodic} {
+		b.Run(policy.String(), func(b *testing.B) {
+			db, err := OpenWithOptions(b.TempDir(), Options{SyncPolicy: policy})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+
+			value := strings.Repeat("v", 100)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if err := db.Put(fmt.Sprintf("key%d", i%1000), value); err != nil {
+						b.Error(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 64}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Add(-time.Hour)
+	db.clock = func() time.Time { return now }
+
+	if err := db.PutWithTTL("session", "data", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("session", "data", 0); err == nil {
+		t.Error("PutWithTTL with zero ttl must fail")
+	}
+	if err := db.Put("persistent", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.Get("session"); err != nil || v != "data" {
+		t.Errorf("Get(session) = %q, %v; want data", v, err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Get(session) after expiration = %v; want ErrNotFound", err)
+	}
+	if err := db.Delete("session"); err != ErrNotFound {
+		t.Errorf("Delete(session) after expiration = %v; want ErrNotFound", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Get(session) after reopen = %v; want ErrNotFound", err)
+	}
+
+	for i := range 4 {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MergeSegments()
+
+	db.mu.RLock()
+	_, inIndex := db.index.get("session")
+	db.mu.RUnlock()
+	if inIndex {
+		t.Error("Merge kept the expired record")
+	}
+	if v, err := db.Get("persistent"); err != nil || v != "data" {
+		t.Errorf("Get(persistent) = %q, %v; want data", v, err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 128}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v1, err := db.CompareAndSwap("key", 0, "v1")
+	if err != nil {
+		t.Fatalf("CompareAndSwap on missing key failed: %v", err)
+	}
+	if _, err := db.CompareAndSwap("key", 0, "v1"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap on existing key with version 0 = %v; want ErrVersionMismatch", err)
+	}
+
+	value, version, err := db.GetWithVersion("key")
+	if err != nil || value != "v1" || version != v1 {
+		t.Errorf("GetWithVersion(key) = %q, %d, %v; want v1, %d", value, version, err, v1)
+	}
+
+	v2, err := db.CompareAndSwap("key", v1, "v2")
+	if err != nil {
+		t.Fatalf("CompareAndSwap with current version failed: %v", err)
+	}
+	if v2 <= v1 {
+		t.Errorf("New version %d is not greater than %d", v2, v1)
+	}
+	if _, err := db.CompareAndSwap("key", v1, "v3"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap with stale version = %v; want ErrVersionMismatch", err)
+	}
+
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 6 {
+		if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(fmt.Sprintf("filler%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MergeSegments()
+	db.mu.RLock()
+	lastSeq := db.lastSeq
+	db.mu.RUnlock()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.lastSeq != lastSeq {
+		t.Errorf("Sequence number after reopen = %d; want %d", db.lastSeq, lastSeq)
+	}
+	if _, version, err := db.GetWithVersion("key"); err != nil || version != v2 {
+		t.Errorf("GetWithVersion(key) after reopen = %d, %v; want %d", version, err, v2)
+	}
+	v3, err := db.CompareAndSwap("key", v2, "v3")
+	if err != nil {
+		t.Fatalf("CompareAndSwap after reopen failed: %v", err)
+	}
+	if v3 <= lastSeq {
+		t.Errorf("New version %d reuses a sequence number up to %d", v3, lastSeq)
+	}
+}
+
+func TestSequenceAfterMerge(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { db.Close() }()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+	// The merge drops the tombstone of d, the newest record, and leaves
+	// no records in the empty active segment.
+	rotate(t, db)
+	db.MergeSegments()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(tmp, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.lastSeq != 5 {
+		t.Errorf("Sequence number after reopen = %d; want 5", db.lastSeq)
+	}
+	version, err := db.CompareAndSwap("d", 0, "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 6 {
+		t.Errorf("Version of the recreated key = %d; want 6", version)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 128, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MergeSegments()
+	if err := db.Put("key0", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"key0": "latest",
+		"key1": "value7",
+		"key2": "value8",
+	}
+	check := func(t *testing.T) {
+		t.Helper()
+		db, err := OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		for k, v := range expected {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, v)
+			}
+		}
+	}
+
+	t.Run("segment order", check)
+
+	t.Run("orphaned files", func(t *testing.T) {
+		// A copy of a live segment not listed in the manifest, as left by
+		// a merge interrupted before the manifest was replaced.
+		segments := segmentFiles(t, tmp)
+		data, err := os.ReadFile(segments[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		orphan := filepath.Join(tmp, segmentPrefix+"9999999999999999999")
+		leftovers := []string{
+			orphan,
+			orphan + hintSuffix,
+			filepath.Join(tmp, mergingPrefix+"1"),
+			filepath.Join(tmp, manifestName+manifestTempSuffix),
+		}
+		for _, path := range leftovers {
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		check(t)
+		for _, path := range leftovers {
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Leftover %s was not removed: %v", filepath.Base(path), err)
+			}
+		}
+	})
+
+	t.Run("missing manifest", func(t *testing.T) {
+		segments := segmentFiles(t, tmp)
+		if err := os.Remove(filepath.Join(tmp, manifestName)); err != nil {
+			t.Fatal(err)
+		}
+		// Without a manifest segments are ordered by name.
+		for i, path := range segments {
+			if err := os.Rename(path, filepath.Join(tmp, fmt.Sprintf("%s%d", segmentPrefix, i))); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(path + hintSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatal(err)
+			}
+		}
+
+		check(t)
+		if _, err := readManifest(tmp); err != nil {
+			t.Errorf("Manifest was not recreated: %v", err)
+		}
+	})
+
+	t.Run("damaged manifest", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(tmp, manifestName), []byte("garbage"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenWithOptions(tmp, opts); !errors.Is(err, errBadManifest) {
+			t.Errorf("Open error = %v; want errBadManifest", err)
+		}
+	})
+}
+
+func TestOpenLegacySegments(t *testing.T) {
+	tmp := t.TempDir()
+	legacyRecord := func(key, value string) []byte {
+		res := binary.LittleEndian.AppendUint32(nil, uint32(len(key)+len(value)+12))
+		res = binary.LittleEndian.AppendUint32(res, uint32(len(key)))
+		res = append(res, key...)
+		res = binary.LittleEndian.AppendUint32(res, uint32(len(value)))
+		return append(res, value...)
+	}
+	var first, second []byte
+	first = append(first, legacyRecord("key1", "old")...)
+	first = append(first, legacyRecord("key2", "value2")...)
+	second = append(second, legacyRecord("key1", "value1")...)
+	// The last write was torn.
+	second = append(second, legacyRecord("key3", "value3")[:10]...)
+	if err := os.WriteFile(filepath.Join(tmp, segmentPrefix+"1"), first, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, segmentPrefix+"2"), second, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenReadOnly(tmp, Options{}); !errors.Is(err, errLegacySegment) {
+		t.Errorf("OpenReadOnly error = %v; want errLegacySegment", err)
+	}
+
+	for range 2 {
+		db, err := Open(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{"key1": "value1", "key2": "value2"} {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%q) = %q, %v; want %q", key, got, err, want)
+			}
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Get of a torn record: %v; want ErrNotFound", err)
+		}
+		if _, version, err := db.GetWithVersion("key1"); err != nil || version != 3 {
+			t.Errorf("key1 version = %d, %v; want 3", version, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
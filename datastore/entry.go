@@ -5,54 +5,267 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+)
+
+var (
+	ErrCorrupted     = errors.New("corrupted record")
+	ErrKeyTooLarge   = errors.New("key is too large")
+	ErrValueTooLarge = errors.New("value is too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type entryKind byte
+
+const (
+	kindPut entryKind = iota
+	kindDelete
+	// kindBatchBegin starts a write batch, its value holds the number of
+	// records in the batch.
+	kindBatchBegin
+	// kindBatchCommit ends a write batch. Records of a batch without the
+	// commit marker are discarded on recovery.
+	kindBatchCommit
 )
 
 type entry struct {
+	kind       entryKind
 	key, value string
+	// expiresAt is the expiration time in Unix nanoseconds, zero means
+	// the entry never expires.
+	expiresAt int64
+	// seq is the sequence number of the write, zero for records written
+	// before sequence numbers were introduced.
+	seq uint64
+	// valueType tells how the value is encoded, records without the type
+	// field hold strings.
+	valueType ValueType
+	// compressed is set when value holds the deflated value.
+	compressed bool
+	// bucket is the ID of the bucket of the key, zero for the default
+	// bucket.
+	bucket uint32
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+// 0           4      5       6                                                 <-- offset
+// (full size) (kind) (flags) (fields...) (kl) (key) (vl) (value) (crc32)
+// 4           1      1       ...         4    ....  4    .....   4           <-- length
+//
+// Optional fields follow the flags in the order of the flag bits:
+//   flagExpires: expiration time, 8 bytes
+//   flagSequence: sequence number, 8 bytes
+//   flagType: value type, 1 byte
+//   flagBucket: bucket ID, 4 bytes
+//
+// flagCompressed has no field, it marks the value as deflated.
+//
+// crc32 (Castagnoli) covers every byte of the record before it.
+
+const (
+	flagExpires byte = 1 << iota
+	flagSequence
+	flagType
+	flagCompressed
+	flagBucket
+)
+
+const (
+	entryHeaderSize    = 6
+	entryMinSize       = entryHeaderSize + 4 + 4 + 4
+	entryMaxFieldsSize = 8 + 8 + 1 + 4
+)
+
+func (e *entry) flags() byte {
+	var flags byte
+	if e.expiresAt != 0 {
+		flags |= flagExpires
+	}
+	if e.seq != 0 {
+		flags |= flagSequence
+	}
+	if e.valueType != TypeString {
+		flags |= flagType
+	}
+	if e.compressed {
+		flags |= flagCompressed
+	}
+	if e.bucket != 0 {
+		flags |= flagBucket
+	}
+	return flags
+}
 
 func (e *entry) Encode() []byte {
-	kl, vl := len(e.key), len(e.value)
-	size := kl + vl + 12
-	res := make([]byte, size)
+	res := e.encodeHeader(len(e.value))
+	res = append(res, e.value...)
+	return binary.LittleEndian.AppendUint32(res, crc32.Checksum(res, crcTable))
+}
+
+// encodedSize returns the size of the record with a value of valueSize
+// bytes.
+func (e *entry) encodedSize(valueSize int) int {
+	size := len(e.key) + valueSize + entryMinSize
+	if e.expiresAt != 0 {
+		size += 8
+	}
+	if e.seq != 0 {
+		size += 8
+	}
+	if e.valueType != TypeString {
+		size++
+	}
+	if e.bucket != 0 {
+		size += 4
+	}
+	return size
+}
+
+// encodeHeader encodes the record up to its value, which is valueSize
+// bytes long, so the value can be streamed after it.
+func (e *entry) encodeHeader(valueSize int) []byte {
+	flags := e.flags()
+	size := e.encodedSize(valueSize)
+
+	res := make([]byte, entryHeaderSize, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
-	return res
+	res[4] = byte(e.kind)
+	res[5] = flags
+	if flags&flagExpires != 0 {
+		res = binary.LittleEndian.AppendUint64(res, uint64(e.expiresAt))
+	}
+	if flags&flagSequence != 0 {
+		res = binary.LittleEndian.AppendUint64(res, e.seq)
+	}
+	if flags&flagType != 0 {
+		res = append(res, byte(e.valueType))
+	}
+	if flags&flagBucket != 0 {
+		res = binary.LittleEndian.AppendUint32(res, e.bucket)
+	}
+	res = binary.LittleEndian.AppendUint32(res, uint32(len(e.key)))
+	res = append(res, e.key...)
+	return binary.LittleEndian.AppendUint32(res, uint32(valueSize))
 }
 
-func (e *entry) Decode(input []byte) {
-	e.key = decodeString(input[4:])
-	e.value = decodeString(input[len(e.key)+8:])
+// checkSize fails when a key or a value exceeds the size limits of a Db.
+// Records have to fit the 4-byte size field whatever the limits.
+func checkSize(keySize, valueSize, maxKeySize, maxValueSize int64) error {
+	if keySize > maxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, keySize, maxKeySize)
+	}
+	if valueSize > maxValueSize || keySize+valueSize > math.MaxUint32-entryMinSize-entryMaxFieldsSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, valueSize, maxValueSize)
+	}
+	return nil
 }
 
-func decodeString(v []byte) string {
+func (e *entry) Decode(input []byte) error {
+	size := len(input)
+	if size < entryMinSize || int(binary.LittleEndian.Uint32(input)) != size {
+		return fmt.Errorf("%w: bad size", ErrCorrupted)
+	}
+	if crc32.Checksum(input[:size-4], crcTable) != binary.LittleEndian.Uint32(input[size-4:]) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+
+	flags := input[5]
+	body := input[entryHeaderSize : size-4]
+	var expiresAt int64
+	if flags&flagExpires != 0 {
+		if len(body) < 8 {
+			return fmt.Errorf("%w: bad expiration time", ErrCorrupted)
+		}
+		expiresAt = int64(binary.LittleEndian.Uint64(body))
+		body = body[8:]
+	}
+	var seq uint64
+	if flags&flagSequence != 0 {
+		if len(body) < 8 {
+			return fmt.Errorf("%w: bad sequence number", ErrCorrupted)
+		}
+		seq = binary.LittleEndian.Uint64(body)
+		body = body[8:]
+	}
+	valueType := TypeString
+	if flags&flagType != 0 {
+		if len(body) < 1 {
+			return fmt.Errorf("%w: bad value type", ErrCorrupted)
+		}
+		valueType = ValueType(body[0])
+		body = body[1:]
+	}
+	var bucket uint32
+	if flags&flagBucket != 0 {
+		if len(body) < 4 {
+			return fmt.Errorf("%w: bad bucket ID", ErrCorrupted)
+		}
+		bucket = binary.LittleEndian.Uint32(body)
+		body = body[4:]
+	}
+	key, ok := decodeString(body)
+	if !ok {
+		return fmt.Errorf("%w: bad key length", ErrCorrupted)
+	}
+	body = body[len(key)+4:]
+	value, ok := decodeString(body)
+	if !ok || len(value)+4 != len(body) {
+		return fmt.Errorf("%w: bad value length", ErrCorrupted)
+	}
+
+	e.kind = entryKind(input[4])
+	e.key = key
+	e.value = value
+	e.expiresAt = expiresAt
+	e.seq = seq
+	e.valueType = valueType
+	e.compressed = flags&flagCompressed != 0
+	e.bucket = bucket
+	return nil
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
+}
+
+func decodeString(v []byte) (string, bool) {
+	if len(v) < 4 {
+		return "", false
+	}
 	l := binary.LittleEndian.Uint32(v)
-	buf := make([]byte, l)
-	copy(buf, v[4:4+int(l)])
-	return string(buf)
+	if uint64(l) > uint64(len(v)-4) {
+		return "", false
+	}
+	return string(v[4 : 4+l]), true
 }
 
+// DecodeFromReader reads one record from in. It returns io.EOF only when
+// in is exhausted exactly on a record boundary, io.ErrUnexpectedEOF when
+// the record is cut short and ErrCorrupted when it fails validation.
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
+			if len(sizeBuf) > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
 			return 0, err
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	if size < entryMinSize {
+		return 0, fmt.Errorf("%w: bad size", ErrCorrupted)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, err
+		}
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
-	return n, nil
+	return n, e.Decode(buf)
 }
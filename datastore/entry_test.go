@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"io"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -21,7 +23,7 @@ func TestReadValue(t *testing.T) {
 	var (
 		a, b entry
 	)
-	a = entry{"key", "test-value"}
+	a = entry{key: "key", value: "test-value"}
 	originalBytes := a.Encode()
 
 	b.Decode(originalBytes)
@@ -43,3 +45,43 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(originalBytes))
 	}
 }
+
+func TestEntry_EncodeTombstone(t *testing.T) {
+	var e entry
+	e.Decode((&entry{kind: kindDelete, key: "key"}).Encode())
+	if e.kind != kindDelete {
+		t.Error("incorrect kind")
+	}
+	if e.key != "key" {
+		t.Error("incorrect key")
+	}
+	if e.value != "" {
+		t.Error("tombstone must not have a value")
+	}
+}
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	data := (&entry{key: "key", value: "value"}).Encode()
+	data[len(data)-6] ^= 0xff
+
+	var e entry
+	if err := e.Decode(data); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Decode() of damaged record = %v; want ErrCorrupted", err)
+	}
+
+	_, err := e.DecodeFromReader(bufio.NewReader(bytes.NewReader(data[:len(data)-2])))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeFromReader() of short record = %v; want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestEntry_EncodeOptionalFields(t *testing.T) {
+	a := entry{key: "key", value: "value", expiresAt: 1700000000000000000, seq: 42, valueType: TypeInt64, bucket: 7}
+	var b entry
+	if err := b.Decode(a.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("Encode/Decode mismatch: %v != %v", a, b)
+	}
+}
@@ -0,0 +1,129 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"iter"
+	"maps"
+	"os"
+)
+
+const (
+	hintSuffix     = ".hint"
+	hintMagic      = "dhnt"
+	hintVersion    = 4
+	hintHeaderSize = 13
+	hintRecordSize = 37
+)
+
+// Hint file lists the latest record of every key of a closed segment, so
+// the index can be rebuilt without reading the segment itself.
+//
+// 0       4         5               13           <-- offset
+// (magic) (version) (segment size)  (records...) (crc32)
+// 4       1         8               ....         4   <-- length
+//
+// record:
+// (kind) (kl) (key) (offset) (size) (expires at) (seq)
+// 1      4    ....  8        8      8            8
+//
+// Keys are index keys. Hints older than version 4 predate buckets, their
+// segments are scanned again so keys starting with a zero byte are caught.
+
+var errBadHint = errors.New("bad hint file")
+
+func hintPath(seg *segment) string {
+	return seg.path + hintSuffix
+}
+
+func writeHint(seg *segment, segmentSize int64, keys segmentKeys, perm os.FileMode) error {
+	size := hintHeaderSize + 4
+	for key := range keys.index.all() {
+		size += len(key) + hintRecordSize
+	}
+	for key := range keys.deleted {
+		size += len(key) + hintRecordSize
+	}
+
+	buf := make([]byte, hintHeaderSize, size)
+	copy(buf, hintMagic)
+	buf[4] = hintVersion
+	binary.LittleEndian.PutUint64(buf[5:], uint64(segmentSize))
+
+	appendRecords := func(kind entryKind, records iter.Seq2[string, recordLocation]) {
+		for key, loc := range records {
+			buf = append(buf, byte(kind))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+			buf = append(buf, key...)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(loc.offset))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(loc.size))
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(loc.expiresAt))
+			buf = binary.LittleEndian.AppendUint64(buf, loc.seq)
+		}
+	}
+	appendRecords(kindPut, keys.index.all())
+	appendRecords(kindDelete, maps.All(keys.deleted))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	return os.WriteFile(hintPath(seg), buf, perm)
+}
+
+// readHint loads the hint file of seg. It fails with errBadHint when the
+// file is damaged or describes a segment of a different size.
+func readHint(seg *segment, segmentSize int64) (segmentKeys, error) {
+	buf, err := os.ReadFile(hintPath(seg))
+	if err != nil {
+		return segmentKeys{}, err
+	}
+	if len(buf) < hintHeaderSize+4 {
+		return segmentKeys{}, fmt.Errorf("%w: too short", errBadHint)
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return segmentKeys{}, fmt.Errorf("%w: checksum mismatch", errBadHint)
+	}
+	if string(body[:4]) != hintMagic || body[4] != hintVersion {
+		return segmentKeys{}, fmt.Errorf("%w: unknown format", errBadHint)
+	}
+	if int64(binary.LittleEndian.Uint64(body[5:])) != segmentSize {
+		return segmentKeys{}, fmt.Errorf("%w: segment size mismatch", errBadHint)
+	}
+
+	keys := newSegmentKeys()
+	rest := body[hintHeaderSize:]
+	for len(rest) > 0 {
+		if len(rest) < 5 {
+			return segmentKeys{}, fmt.Errorf("%w: truncated record", errBadHint)
+		}
+		kind := entryKind(rest[0])
+		kl := int(binary.LittleEndian.Uint32(rest[1:]))
+		if len(rest) < kl+hintRecordSize {
+			return segmentKeys{}, fmt.Errorf("%w: truncated record", errBadHint)
+		}
+		key := string(rest[5 : 5+kl])
+		loc := recordLocation{
+			segment:   seg,
+			offset:    int64(binary.LittleEndian.Uint64(rest[5+kl:])),
+			size:      int64(binary.LittleEndian.Uint64(rest[13+kl:])),
+			expiresAt: int64(binary.LittleEndian.Uint64(rest[21+kl:])),
+			seq:       binary.LittleEndian.Uint64(rest[29+kl:]),
+		}
+		if kind == kindDelete {
+			keys.remove(key, loc)
+		} else {
+			keys.put(key, loc)
+		}
+		rest = rest[kl+hintRecordSize:]
+	}
+	return keys, nil
+}
+
+func removeHint(seg *segment) error {
+	err := os.Remove(hintPath(seg))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"iter"
+	"math/rand/v2"
+)
+
+const maxIndexLevel = 24
+
+type indexNode struct {
+	key  string
+	loc  recordLocation
+	next []*indexNode
+}
+
+// keyIndex is a skip list that maps keys to the locations of their
+// records in key order.
+type keyIndex struct {
+	head  indexNode
+	level int
+	size  int
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  indexNode{next: make([]*indexNode, maxIndexLevel)},
+		level: 1,
+	}
+}
+
+// find returns the first node with a key not less than key. When prev is
+// not nil, it is filled with the last node before key on every level.
+func (idx *keyIndex) find(key string, prev *[maxIndexLevel]*indexNode) *indexNode {
+	n := &idx.head
+	for l := idx.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].key < key {
+			n = n.next[l]
+		}
+		if prev != nil {
+			prev[l] = n
+		}
+	}
+	return n.next[0]
+}
+
+func (idx *keyIndex) get(key string) (recordLocation, bool) {
+	n := idx.find(key, nil)
+	if n == nil || n.key != key {
+		return recordLocation{}, false
+	}
+	return n.loc, true
+}
+
+func (idx *keyIndex) set(key string, loc recordLocation) {
+	var prev [maxIndexLevel]*indexNode
+	n := idx.find(key, &prev)
+	if n != nil && n.key == key {
+		n.loc = loc
+		return
+	}
+
+	level := 1
+	for level < maxIndexLevel && rand.IntN(4) == 0 {
+		level++
+	}
+	for l := idx.level; l < level; l++ {
+		prev[l] = &idx.head
+	}
+	idx.level = max(idx.level, level)
+
+	n = &indexNode{
+		key:  key,
+		loc:  loc,
+		next: make([]*indexNode, level),
+	}
+	for l := range level {
+		n.next[l] = prev[l].next[l]
+		prev[l].next[l] = n
+	}
+	idx.size++
+}
+
+func (idx *keyIndex) delete(key string) {
+	var prev [maxIndexLevel]*indexNode
+	n := idx.find(key, &prev)
+	if n == nil || n.key != key {
+		return
+	}
+	for l := range n.next {
+		prev[l].next[l] = n.next[l]
+	}
+	idx.size--
+}
+
+func (idx *keyIndex) len() int {
+	return idx.size
+}
+
+// seek returns the first record with a key not less than from.
+func (idx *keyIndex) seek(from string) *indexNode {
+	return idx.find(from, nil)
+}
+
+func (idx *keyIndex) all() iter.Seq2[string, recordLocation] {
+	return func(yield func(string, recordLocation) bool) {
+		for n := idx.head.next[0]; n != nil; n = n.next[0] {
+			if !yield(n.key, n.loc) {
+				return
+			}
+		}
+	}
+}
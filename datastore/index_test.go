@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	idx := newKeyIndex()
+	expected := make(map[string]int64)
+
+	for i := range 1000 {
+		key := fmt.Sprintf("key%d", rand.IntN(300))
+		if i%3 == 0 {
+			idx.delete(key)
+			delete(expected, key)
+		} else {
+			idx.set(key, recordLocation{offset: int64(i)})
+			expected[key] = int64(i)
+		}
+	}
+
+	if idx.len() != len(expected) {
+		t.Errorf("len() = %d; want %d", idx.len(), len(expected))
+	}
+	for key, offset := range expected {
+		loc, ok := idx.get(key)
+		if !ok || loc.offset != offset {
+			t.Errorf("get(%q) = %d, %v; want %d", key, loc.offset, ok, offset)
+		}
+	}
+	if _, ok := idx.get("missing"); ok {
+		t.Error("get(missing) found a record")
+	}
+
+	var keys []string
+	for key := range idx.all() {
+		keys = append(keys, key)
+	}
+	if !slices.IsSorted(keys) || len(keys) != len(expected) {
+		t.Errorf("all() returned %d unsorted or missing keys", len(keys))
+	}
+
+	if n := idx.seek("key2"); n == nil || n.key < "key2" {
+		t.Errorf("seek(key2) returned a key before key2")
+	}
+	if n := idx.seek("zzz"); n != nil {
+		t.Errorf("seek(zzz) = %q; want nil", n.key)
+	}
+}
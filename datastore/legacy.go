@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Segments written before segments had a header hold bare records with no
+// kind, checksum or sequence number:
+//
+// 0           4    8     kl+8  kl+12     <-- offset
+// (full size) (kl) (key) (vl)  (value)
+// 4           4    ....  4     .....     <-- length
+//
+// Such directories have no manifest either. Open converts their segments
+// to the current format in place.
+
+const legacyRecordMinSize = 12
+
+var errLegacySegment = errors.New("segment has no header, it was written before checksummed records and must be converted by opening the directory for writing")
+
+// isLegacySegment reports whether the file at path starts with a record of
+// the old format instead of a segment header. Empty files have neither.
+func isLegacySegment(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		// A shorter file cannot hold a whole legacy record either.
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return true, nil
+		}
+		return false, err
+	}
+	return string(magic) != segmentMagic, nil
+}
+
+// convertLegacySegment rewrites the legacy segment at path in the current
+// format. Its records become puts numbered from seq+1, the last number is
+// returned. A torn record at the end is dropped. The converted segment is
+// not encrypted, merges encrypt its values with the current key.
+func convertLegacySegment(path string, seq uint64, perm os.FileMode) (uint64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return seq, err
+	}
+	defer src.Close()
+
+	tmpPath := filepath.Join(filepath.Dir(path), mergingPrefix+filepath.Base(path))
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return seq, err
+	}
+	fail := func(err error) (uint64, error) {
+		dst.Close()
+		os.Remove(tmpPath)
+		return seq, fmt.Errorf("failed to convert legacy segment: %w", err)
+	}
+
+	reader := bufio.NewReader(src)
+	writer := bufio.NewWriter(dst)
+	if _, err := writer.Write(encodeSegmentHeader(0)); err != nil {
+		return fail(err)
+	}
+	for {
+		e, err := decodeLegacyRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Printf("recoverSegment: dropped torn tail of legacy segment %s\n", path)
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if reservedKey(e.key) {
+			return fail(fmt.Errorf("%w: key %q", ErrReservedKey, e.key))
+		}
+		seq++
+		e.seq = seq
+		if _, err := writer.Write(e.Encode()); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return seq, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return seq, err
+	}
+	fmt.Printf("recoverSegment: converted legacy segment %s\n", path)
+	return seq, syncDir(filepath.Dir(path))
+}
+
+// decodeLegacyRecord reads a record of the old format as a put. It returns
+// io.EOF at the end of the segment and io.ErrUnexpectedEOF for a record
+// cut short.
+func decodeLegacyRecord(r *bufio.Reader) (entry, error) {
+	sizeBuf, err := r.Peek(4)
+	if err != nil {
+		if err == io.EOF && len(sizeBuf) > 0 {
+			return entry{}, io.ErrUnexpectedEOF
+		}
+		return entry{}, err
+	}
+	size := int(binary.LittleEndian.Uint32(sizeBuf))
+	if size < legacyRecordMinSize {
+		return entry{}, fmt.Errorf("%w: bad legacy record size %d", ErrCorrupted, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return entry{}, err
+	}
+
+	kl := int(binary.LittleEndian.Uint32(buf[4:]))
+	if kl > size-legacyRecordMinSize {
+		return entry{}, fmt.Errorf("%w: bad legacy key size %d", ErrCorrupted, kl)
+	}
+	vl := int(binary.LittleEndian.Uint32(buf[8+kl:]))
+	if vl != size-legacyRecordMinSize-kl {
+		return entry{}, fmt.Errorf("%w: bad legacy value size %d", ErrCorrupted, vl)
+	}
+	return entry{
+		kind:  kindPut,
+		key:   string(buf[8 : 8+kl]),
+		value: string(buf[12+kl:]),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A writer holds an exclusive lock of LOCK while the database is open, so
+// a second writer fails with ErrLocked. Read-only opens do not take it and
+// work next to the writer.
+//
+// LOCK.load guards loading the directory: a writer holds it exclusively
+// while it recovers the directory, which truncates torn tails and removes
+// leftover files, and read-only opens hold it shared while they load, so
+// neither sees the other half done.
+const (
+	lockName     = "LOCK"
+	loadLockName = "LOCK.load"
+)
+
+var ErrLocked = errors.New("database directory is in use")
+
+// lockDir takes the writer lock of dir. It is held until the returned file
+// is closed.
+func lockDir(dir string, perm os.FileMode) (*os.File, error) {
+	f, err := openLockFile(filepath.Join(dir, lockName), perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, false, false); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %w", ErrLocked, dir, err)
+	}
+	return f, nil
+}
+
+// lockLoad waits for the load lock of dir, a shared one for read-only
+// opens. It is held until the returned file is closed.
+func lockLoad(dir string, shared bool, perm os.FileMode) (*os.File, error) {
+	f, err := openLockFile(filepath.Join(dir, loadLockName), perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, shared, true); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", loadLockName, err)
+	}
+	return f, nil
+}
+
+func openLockFile(path string, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, perm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return f, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package datastore
+
+import "os"
+
+// flock does nothing where flock(2) is missing, the directory is not
+// protected from other processes there.
+func flock(f *os.File, shared, wait bool) error {
+	return nil
+}
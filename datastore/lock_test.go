@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 128, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Open error = %v; want ErrLocked", err)
+	}
+
+	// Readers work next to the running writer on the state as of their
+	// open, while the writer goes on and merges the segments they read.
+	r1, err := OpenReadOnly(tmp, opts)
+	if err != nil {
+		t.Fatalf("OpenReadOnly next to a writer failed: %v", err)
+	}
+	defer r1.Close()
+	r2, err := OpenReadOnly(tmp, opts)
+	if err != nil {
+		t.Fatalf("second OpenReadOnly failed: %v", err)
+	}
+	defer r2.Close()
+
+	if err := db.Put("key0", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, db)
+	db.MergeSegments()
+
+	for _, r := range []*Db{r1, r2} {
+		for i := range 5 {
+			key, want := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i+5)
+			if got, err := r.Get(key); err != nil || got != want {
+				t.Errorf("reader Get(%s) = %q, %v; want %q", key, got, err, want)
+			}
+		}
+	}
+
+	r3, err := OpenReadOnly(tmp, opts)
+	if err != nil {
+		t.Fatalf("OpenReadOnly after a merge failed: %v", err)
+	}
+	defer r3.Close()
+	if got, err := r3.Get("key0"); err != nil || got != "latest" {
+		t.Errorf("new reader Get(key0) = %q, %v; want latest", got, err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 128, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Put(key, strings.Repeat(key, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record must be skipped but left in place.
+	segments := segmentFiles(t, tmp)
+	last := segments[len(segments)-1]
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0xff, 0xff}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before := dirState(t, tmp)
+
+	db, err = OpenReadOnly(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("e"); err != nil || value != strings.Repeat("e", 20) {
+		t.Errorf("Get(e) = %q, %v", value, err)
+	}
+	if _, err := db.Get("b"); err != ErrNotFound {
+		t.Errorf("Get(b) error = %v; want ErrNotFound", err)
+	}
+	if err := db.Put("f", "value"); err != ErrReadOnly {
+		t.Errorf("Put error = %v; want ErrReadOnly", err)
+	}
+	if err := db.Delete("a"); err != ErrReadOnly {
+		t.Errorf("Delete error = %v; want ErrReadOnly", err)
+	}
+	if err := db.PutReader("f", strings.NewReader("value"), 5); err != ErrReadOnly {
+		t.Errorf("PutReader error = %v; want ErrReadOnly", err)
+	}
+	db.MergeSegments()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := dirState(t, tmp); !slices.Equal(before, after) {
+		t.Errorf("read-only open changed the directory:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+// dirState lists the names and sizes of the files in dir.
+func dirState(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state []string
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, fmt.Sprintf("%s:%d", file.Name(), info.Size()))
+	}
+	return state
+}
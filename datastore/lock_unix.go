@@ -0,0 +1,24 @@
+//go:build unix
+
+package datastore
+
+import (
+	"os"
+	"syscall"
+)
+
+func flock(f *os.File, shared, wait bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+const (
+	manifestName       = "MANIFEST"
+	manifestTempSuffix = ".tmp"
+	manifestMagic      = "dmft"
+	manifestVersion    = 3
+	manifestHeaderSize = 9
+)
+
+// Manifest lists the live segments of the database from the oldest to the
+// newest. It is replaced atomically, so a segment file takes part in the
+// database only from the moment the manifest names it: files left behind
+// by an interrupted rotation or merge are ignored and removed on Open.
+//
+// 0       4         5         9                                            <-- offset
+// (magic) (version) (count)   (names...) (buckets...) (last seq) (crc32)
+// 4       1         4         ....       ....         8          4  <-- length
+//
+// name:
+// (nl) (name)
+// 4    ....
+//
+// Version 2 adds the bucket registry, see appendBuckets, and version 3 the
+// last sequence number. Merges drop the records written over and the
+// tombstones, so the segments alone may not hold the last number issued.
+
+var (
+	errBadManifest = errors.New("bad manifest file")
+	// errManifestNotSynced is returned by writeManifest when the new
+	// manifest is in place but its directory entry may not survive a crash.
+	errManifestNotSynced = errors.New("manifest written but not synced")
+)
+
+func manifestPath(dir string) string {
+	return filepath.Join(dir, manifestName)
+}
+
+// manifest is the contents of a manifest file.
+type manifest struct {
+	names   []string
+	buckets bucketRegistry
+	lastSeq uint64
+}
+
+// writeManifest replaces the manifest of dir with the segments through a
+// temporary file, so a crash leaves either the old or the new manifest.
+// Errors wrapping errManifestNotSynced come after the rename: the new
+// manifest is the one in use and the files it names must be kept.
+func writeManifest(dir string, segments []*segment, buckets bucketRegistry, lastSeq uint64, perm os.FileMode) error {
+	buf := make([]byte, manifestHeaderSize)
+	copy(buf, manifestMagic)
+	buf[4] = manifestVersion
+	binary.LittleEndian.PutUint32(buf[5:], uint32(len(segments)))
+	for _, seg := range segments {
+		name := filepath.Base(seg.path)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(name)))
+		buf = append(buf, name...)
+	}
+	buf = appendBuckets(buf, buckets)
+	buf = binary.LittleEndian.AppendUint64(buf, lastSeq)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	tmpPath := manifestPath(dir) + manifestTempSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, manifestPath(dir)); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("%w: %w", errManifestNotSynced, err)
+	}
+	return nil
+}
+
+// readManifest returns the manifest of dir. Its segment file names are
+// listed oldest first.
+func readManifest(dir string) (manifest, error) {
+	buf, err := os.ReadFile(manifestPath(dir))
+	if err != nil {
+		return manifest{}, err
+	}
+	if len(buf) < manifestHeaderSize+4 {
+		return manifest{}, fmt.Errorf("%w: too short", errBadManifest)
+	}
+	body := buf[:len(buf)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(buf[len(body):]) {
+		return manifest{}, fmt.Errorf("%w: checksum mismatch", errBadManifest)
+	}
+	version := body[4]
+	if string(body[:4]) != manifestMagic || version < 1 || version > manifestVersion {
+		return manifest{}, fmt.Errorf("%w: unknown format", errBadManifest)
+	}
+
+	count := int(binary.LittleEndian.Uint32(body[5:]))
+	names := make([]string, 0, count)
+	rest := body[manifestHeaderSize:]
+	for len(names) < count {
+		name, ok := decodeString(rest)
+		if !ok {
+			return manifest{}, fmt.Errorf("%w: truncated name", errBadManifest)
+		}
+		if name != filepath.Base(name) {
+			return manifest{}, fmt.Errorf("%w: bad segment name %q", errBadManifest, name)
+		}
+		names = append(names, name)
+		rest = rest[4+len(name):]
+	}
+
+	m := manifest{names: names, buckets: newBucketRegistry()}
+	if version >= 2 {
+		if m.buckets, rest, err = decodeBuckets(rest); err != nil {
+			return manifest{}, fmt.Errorf("%w: %w", errBadManifest, err)
+		}
+	}
+	if version >= 3 {
+		if len(rest) < 8 {
+			return manifest{}, fmt.Errorf("%w: truncated sequence number", errBadManifest)
+		}
+		m.lastSeq = binary.LittleEndian.Uint64(rest)
+		rest = rest[8:]
+	}
+	if len(rest) != 0 {
+		return manifest{}, fmt.Errorf("%w: trailing data", errBadManifest)
+	}
+	return m, nil
+}
+
+// syncDir flushes the directory entries of dir, so renames and removals
+// survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// saveManifest records segments as the live segment set together with the
+// buckets and the last sequence number. It must be called under db.mu.
+//
+// A manifest that was renamed into place but not synced is already the one
+// Open reads, so saveManifest reports success and callers commit the change
+// rather than undo it and delete the files the manifest names.
+func (db *Db) saveManifest(segments []*segment) error {
+	err := writeManifest(db.dir, segments, db.buckets, db.lastSeq, db.opts.FileMode)
+	if errors.Is(err, errManifestNotSynced) {
+		fmt.Printf("saveManifest: %v\n", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package datastore
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("memory-mapped reads are not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,196 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Options configure a Db opened with OpenWithOptions. Zero fields are
+// replaced with the values from DefaultOptions.
+type Options struct {
+	// SegmentSize is the size in bytes after which the active segment is
+	// closed and a new one is started.
+	SegmentSize int64
+	// MergePolicy decides when closed segments are merged.
+	MergePolicy MergePolicy
+	// SyncPolicy decides when written records are flushed to disk.
+	SyncPolicy SyncPolicy
+	// SyncInterval is the flush period of SyncPeriodic.
+	SyncInterval time.Duration
+	// ReadConcurrency limits the number of reads served at the same time.
+	// Reads of a segment share one file handle and run in parallel, so
+	// this bounds the file reads in flight. Zero means no limit.
+	ReadConcurrency int
+	// MmapReads serves reads of closed segments from memory mappings
+	// instead of file reads. It is supported on Linux only, elsewhere
+	// segments are read from files.
+	MmapReads bool
+	// CacheSize is the number of bytes of keys and values kept in memory
+	// by a least recently used cache of read values. Zero disables it.
+	CacheSize int64
+	// MaxKeySize and MaxValueSize limit the size in bytes of keys and
+	// values, larger ones are rejected with ErrKeyTooLarge and
+	// ErrValueTooLarge.
+	MaxKeySize   int64
+	MaxValueSize int64
+	// Compression decides when values are compressed. Values written by
+	// PutReader are compressed by merges only.
+	Compression Compression
+	// MinCompressSize is the size in bytes from which values are
+	// compressed.
+	MinCompressSize int64
+	// Keyring holds the keys that encrypt values at rest. Keys are not
+	// encrypted, see Keyring. The zero value disables encryption. With a
+	// keyring PutReader buffers each value in memory, because it is
+	// sealed as a whole.
+	Keyring Keyring
+	// FileMode is the permission of segment and hint files.
+	FileMode os.FileMode
+	// DirMode is the permission of the data directory when it is created.
+	DirMode os.FileMode
+}
+
+// MergePolicy selects the closed segments that are worth merging, so
+// large segments that are mostly live are not rewritten over and over.
+type MergePolicy struct {
+	// MinSegments is the number of segments, including the active one,
+	// that triggers a merge. A negative value disables automatic merges.
+	MinSegments int
+	// GarbageRatio is the share of dead bytes in a segment that makes it
+	// a merge candidate.
+	GarbageRatio float64
+	// SmallSegmentSize is the number of live bytes below which a segment
+	// is a merge candidate whatever its garbage, so small segments are
+	// merged together.
+	SmallSegmentSize int64
+	// MaxMergeSize limits the live bytes rewritten by a single merge.
+	// Zero means no limit.
+	MaxMergeSize int64
+}
+
+func (p MergePolicy) shouldMerge(segments []*segment) bool {
+	if p.MinSegments < 0 || len(segments) < p.MinSegments {
+		return false
+	}
+	return len(p.selectSegments(segments[:len(segments)-1])) > 0
+}
+
+// selectSegments returns the closed segments to merge, oldest first.
+func (p MergePolicy) selectSegments(closed []*segment) []*segment {
+	var (
+		selected []*segment
+		total    int64
+	)
+	for _, seg := range closed {
+		garbage := seg.garbageRatio() >= p.GarbageRatio
+		if !garbage && seg.liveBytes() >= p.SmallSegmentSize {
+			continue
+		}
+		live := seg.liveBytes()
+		if p.MaxMergeSize > 0 && len(selected) > 0 && total+live > p.MaxMergeSize {
+			break
+		}
+		selected = append(selected, seg)
+		total += live
+	}
+
+	// Rewriting a single segment only pays off when it frees its garbage.
+	if len(selected) == 1 && selected[0].garbageRatio() < p.GarbageRatio {
+		return nil
+	}
+	return selected
+}
+
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing to the operating system.
+	SyncNone SyncPolicy = iota
+	// SyncAlways flushes the active segment after every write.
+	SyncAlways
+	// SyncGroup flushes after every write too, but concurrent writes wait
+	// for a single shared flush.
+	SyncGroup
+	// SyncPeriodic flushes the active segment every SyncInterval, so a
+	// crash loses at most the writes of the last interval.
+	SyncPeriodic
+)
+
+var syncPolicyNames = map[SyncPolicy]string{
+	SyncNone:     "none",
+	SyncAlways:   "always",
+	SyncGroup:    "group",
+	SyncPeriodic: "periodic",
+}
+
+func (p SyncPolicy) String() string {
+	if name, ok := syncPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+// Set parses the policy name, so SyncPolicy can be used as a flag.Value.
+func (p *SyncPolicy) Set(name string) error {
+	for policy, policyName := range syncPolicyNames {
+		if policyName == name {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q", name)
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize: 10 * 1024 * 1024,
+		MergePolicy: MergePolicy{
+			MinSegments:  3,
+			GarbageRatio: 0.5,
+		},
+		SyncPolicy:      SyncNone,
+		SyncInterval:    100 * time.Millisecond,
+		MaxKeySize:      64 * 1024,
+		MaxValueSize:    256 * 1024 * 1024,
+		Compression:     CompressionNone,
+		MinCompressSize: 256,
+		FileMode:        0600,
+		DirMode:         0755,
+	}
+}
+
+func (opts Options) withDefaults() Options {
+	def := DefaultOptions()
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = def.SegmentSize
+	}
+	if opts.MergePolicy.MinSegments == 0 {
+		opts.MergePolicy.MinSegments = def.MergePolicy.MinSegments
+	}
+	if opts.MergePolicy.GarbageRatio == 0 {
+		opts.MergePolicy.GarbageRatio = def.MergePolicy.GarbageRatio
+	}
+	if opts.MergePolicy.SmallSegmentSize == 0 {
+		opts.MergePolicy.SmallSegmentSize = opts.SegmentSize / 4
+	}
+	if opts.SyncInterval == 0 {
+		opts.SyncInterval = def.SyncInterval
+	}
+	if opts.MaxKeySize == 0 {
+		opts.MaxKeySize = def.MaxKeySize
+	}
+	if opts.MaxValueSize == 0 {
+		opts.MaxValueSize = def.MaxValueSize
+	}
+	if opts.MinCompressSize == 0 {
+		opts.MinCompressSize = def.MinCompressSize
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = def.FileMode
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = def.DirMode
+	}
+	return opts
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"os"
+)
+
+// segmentReaders holds a read-only handle of every segment. Records are
+// read with ReadAt, which does not move the file offset, so any number of
+// reads are served in parallel from the same handle. With mmap, closed
+// segments are memory-mapped and records are decoded from the mapping.
+// The maps are guarded by db.mu, so a segment is never unmapped while it
+// is being read.
+type segmentReaders struct {
+	files   map[*segment]*os.File
+	maps    map[*segment][]byte
+	mmap    bool
+	ciphers map[uint16]cipher.AEAD
+}
+
+func newSegmentReaders(mmap bool, ciphers map[uint16]cipher.AEAD) segmentReaders {
+	return segmentReaders{
+		files:   make(map[*segment]*os.File),
+		maps:    make(map[*segment][]byte),
+		mmap:    mmap,
+		ciphers: ciphers,
+	}
+}
+
+// get returns the value stored at loc in its string form.
+func (sr segmentReaders) get(loc recordLocation) (string, error) {
+	e, err := sr.read(loc)
+	if err != nil {
+		return "", err
+	}
+	return e.stringValue(), nil
+}
+
+func (sr segmentReaders) read(loc recordLocation) (entry, error) {
+	var buf []byte
+	if data, ok := sr.maps[loc.segment]; ok {
+		if loc.offset+loc.size > int64(len(data)) {
+			return entry{}, fmt.Errorf("%w: record is out of the segment", ErrCorrupted)
+		}
+		buf = data[loc.offset : loc.offset+loc.size]
+	} else {
+		f, ok := sr.files[loc.segment]
+		if !ok {
+			return entry{}, fmt.Errorf("segment is not open for reads: %s", loc.segment.path)
+		}
+		buf = make([]byte, loc.size)
+		if _, err := f.ReadAt(buf, loc.offset); err != nil {
+			return entry{}, err
+		}
+	}
+
+	var e entry
+	if err := e.Decode(buf); err != nil {
+		return entry{}, err
+	}
+	if loc.segment.keyID != 0 && e.kind == kindPut {
+		if err := e.decrypt(sr.ciphers[loc.segment.keyID]); err != nil {
+			return entry{}, err
+		}
+	}
+	if err := e.decompress(); err != nil {
+		return entry{}, err
+	}
+	return e, nil
+}
+
+func (sr segmentReaders) open(seg *segment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	sr.files[seg] = f
+	return nil
+}
+
+// seal maps seg once it is closed and will not grow anymore. Reads fall
+// back to the file when the mapping fails.
+func (sr segmentReaders) seal(seg *segment) {
+	f, ok := sr.files[seg]
+	if !sr.mmap || !ok || seg.size == 0 {
+		return
+	}
+	data, err := mmapFile(f, seg.size)
+	if err != nil {
+		fmt.Printf("seal: failed to map segment: %v\n", err)
+		return
+	}
+	sr.maps[seg] = data
+}
+
+func (sr segmentReaders) close(seg *segment) {
+	if data, ok := sr.maps[seg]; ok {
+		delete(sr.maps, seg)
+		if err := munmap(data); err != nil {
+			fmt.Printf("close: failed to unmap segment: %v\n", err)
+		}
+	}
+	if f, ok := sr.files[seg]; ok {
+		delete(sr.files, seg)
+		f.Close()
+	}
+}
+
+func (sr segmentReaders) closeAll() {
+	for seg := range sr.files {
+		sr.close(seg)
+	}
+}
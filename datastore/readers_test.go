@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// seekReader is the former read path: a single goroutine per segment that
+// seeks to the record and decodes it, so reads of a segment are serialized.
+type seekReader struct {
+	calls chan seekCall
+}
+
+type seekCall struct {
+	offset int64
+	result chan<- string
+}
+
+func newSeekReader(f *os.File) *seekReader {
+	r := &seekReader{calls: make(chan seekCall)}
+	go func() {
+		for call := range r.calls {
+			if _, err := f.Seek(call.offset, io.SeekStart); err != nil {
+				call.result <- ""
+				continue
+			}
+			var e entry
+			if _, err := e.DecodeFromReader(bufio.NewReader(f)); err != nil {
+				call.result <- ""
+				continue
+			}
+			call.result <- e.value
+		}
+	}()
+	return r
+}
+
+func (r *seekReader) get(loc recordLocation) string {
+	result := make(chan string)
+	r.calls <- seekCall{offset: loc.offset, result: result}
+	return <-result
+}
+
+func TestSegmentReaders_ConcurrentGet(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 100
+	for i := range keys {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range keys {
+				k := (i + w*13) % keys
+				value, err := db.Get(fmt.Sprintf("key%d", k))
+				if err != nil || value != fmt.Sprintf("value%d", k) {
+					t.Errorf("Get(key%d) = %q, %v", k, value, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func benchmarkReads(b *testing.B, seek bool) {
+	db, err := Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 1000
+	for i := range keys {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	locs := make([]recordLocation, 0, keys)
+	for _, loc := range db.activeSegment.index.all() {
+		locs = append(locs, loc)
+	}
+	get := func(loc recordLocation) string {
+		value, _ := db.readers.get(loc)
+		return value
+	}
+	if seek {
+		f, err := os.Open(db.activeSegment.path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		r := newSeekReader(f)
+		defer close(r.calls)
+		get = r.get
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if get(locs[i%len(locs)]) == "" {
+				b.Error("empty value")
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkSegmentReads(b *testing.B) {
+	b.Run("seek", func(b *testing.B) {
+		benchmarkReads(b, true)
+	})
+	b.Run("pread", func(b *testing.B) {
+		benchmarkReads(b, false)
+	})
+}
+
+func TestMmapReads(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 256, MmapReads: true, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]string)
+	for i := range 40 {
+		key, value := fmt.Sprintf("key%d", i%15), fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		for k, v := range expected {
+			if got, err := db.Get(k); err != nil || got != v {
+				t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, v)
+			}
+		}
+		if runtime.GOOS == "linux" && len(db.readers.maps) != len(db.segments)-1 {
+			t.Errorf("%d segments are mapped; want %d", len(db.readers.maps), len(db.segments)-1)
+		}
+	}
+	check(t, db)
+
+	snapshot := db.Snapshot()
+	db.MergeSegments()
+	if got, err := snapshot.Get("key0"); err != nil || got != expected["key0"] {
+		t.Errorf("snapshot.Get(key0) = %q, %v; want %q", got, err, expected["key0"])
+	}
+	if err := snapshot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+}
@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"iter"
+	"strings"
+)
+
+const iteratorPageSize = 256
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Scan returns up to limit records with keys having the prefix, in key
+// order, starting from the first key not less than start. A limit that
+// is not positive means no limit.
+func (db *Db) Scan(prefix, start string, limit int) ([]KeyValue, error) {
+	return db.scan(0, prefix, start, limit)
+}
+
+func (db *Db) scan(bucket uint32, prefix, start string, limit int) ([]KeyValue, error) {
+	prefix, start, ok := bucketRange(bucket, prefix, start)
+	if !ok {
+		return nil, nil
+	}
+	if db.readSem != nil {
+		db.readSem <- struct{}{}
+		defer func() { <-db.readSem }()
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.reads.Add(1)
+	var res []KeyValue
+	for key, loc := range db.rangeKeys(prefix, start) {
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		value, err := db.readers.get(loc)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, KeyValue{Key: key[len(bucketPrefix(bucket)):], Value: value})
+	}
+	return res, nil
+}
+
+// rangeKeys iterates over the live keys with the prefix starting from
+// start, merging the index of the active segment with db.index. It must
+// be called under db.mu.
+func (db *Db) rangeKeys(prefix, start string) iter.Seq2[string, recordLocation] {
+	from := max(prefix, start)
+	now := db.clock().UnixNano()
+
+	return func(yield func(string, recordLocation) bool) {
+		active, closed := db.activeSegment.index.seek(from), db.index.seek(from)
+		for active != nil || closed != nil {
+			var n *indexNode
+			switch {
+			case closed == nil || active != nil && active.key < closed.key:
+				n, active = active, active.next[0]
+			case active == nil || closed.key < active.key:
+				n, closed = closed, closed.next[0]
+			default:
+				n, active, closed = active, active.next[0], closed.next[0]
+			}
+
+			if !strings.HasPrefix(n.key, prefix) {
+				return
+			}
+			if n.loc.expired(now) {
+				continue
+			}
+			if !yield(n.key, n.loc) {
+				return
+			}
+		}
+	}
+}
+
+// rangeIndex iterates over the keys of idx with the prefix starting from
+// start.
+func rangeIndex(idx *keyIndex, prefix, start string) iter.Seq2[string, recordLocation] {
+	return func(yield func(string, recordLocation) bool) {
+		for n := idx.seek(max(prefix, start)); n != nil; n = n.next[0] {
+			if !strings.HasPrefix(n.key, prefix) || !yield(n.key, n.loc) {
+				return
+			}
+		}
+	}
+}
+
+// Iterator walks over the records with keys having a prefix in key order.
+// It reads the db in pages, so writers are not blocked while iterating.
+// Keys put or deleted during the iteration may or may not be seen.
+type Iterator struct {
+	scan   func(prefix, start string, limit int) ([]KeyValue, error)
+	prefix string
+	start  string
+	page   []KeyValue
+	pos    int
+	done   bool
+	err    error
+}
+
+func (db *Db) NewIterator(prefix string) *Iterator {
+	return newIterator(db.Scan, prefix)
+}
+
+func newIterator(scan func(prefix, start string, limit int) ([]KeyValue, error), prefix string) *Iterator {
+	return &Iterator{
+		scan:   scan,
+		prefix: prefix,
+		start:  prefix,
+		pos:    -1,
+	}
+}
+
+// Next advances the iterator and reports whether there is a record.
+func (it *Iterator) Next() bool {
+	if it.pos+1 < len(it.page) {
+		it.pos++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+
+	it.page, it.err = it.scan(it.prefix, it.start, iteratorPageSize)
+	if it.err != nil {
+		it.page = nil
+		return false
+	}
+	if len(it.page) < iteratorPageSize {
+		it.done = true
+	}
+	if len(it.page) == 0 {
+		return false
+	}
+	it.start = it.page[len(it.page)-1].Key + "\x00"
+	it.pos = 0
+	return true
+}
+
+func (it *Iterator) Key() string {
+	return it.page[it.pos].Key
+}
+
+func (it *Iterator) Value() string {
+	return it.page[it.pos].Value
+}
+
+// Err returns the error that stopped the iteration.
+func (it *Iterator) Err() error {
+	return it.err
+}
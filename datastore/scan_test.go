@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{SegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user:3", "user:1", "item:1", "user:2", "user:4", "zzz"} {
+		if err := db.Put(key, "v-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("user:2", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user:4"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.Scan("user:", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []KeyValue{
+		{"user:1", "v-user:1"},
+		{"user:2", "updated"},
+		{"user:3", "v-user:3"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan(user:) = %v; want %v", got, want)
+	}
+
+	got, err = db.Scan("user:", "user:2", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("Scan(user:, user:2, 1) = %v; want %v", got, want[1:2])
+	}
+
+	got, err = db.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 || got[0].Key != "item:1" || got[4].Key != "zzz" {
+		t.Errorf("Scan of all keys = %v", got)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{SegmentSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n := iteratorPageSize*2 + 10
+	for i := range n {
+		if err := db.Put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	it := db.NewIterator("key")
+	i := 0
+	for it.Next() {
+		if key := fmt.Sprintf("key%04d", i); it.Key() != key {
+			t.Fatalf("Key() = %q; want %q", it.Key(), key)
+		}
+		if value := fmt.Sprintf("value%d", i); it.Value() != value {
+			t.Fatalf("Value() = %q; want %q", it.Value(), value)
+		}
+		i++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Errorf("Iterator returned %d records; want %d", i, n)
+	}
+}
@@ -2,31 +2,105 @@ package datastore
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"time"
 )
 
+const (
+	segmentMagic      = "dseg"
+	segmentVersion    = 1
+	segmentHeaderSize = 8
+)
+
+// 0       4         5        7           <-- offset
+// (magic) (version) (key id) (reserved)
+// 4       1         2        1           <-- length
+//
+// key id is the ID of the key that encrypts the values of the segment,
+// zero for a segment that is not encrypted.
+
+func encodeSegmentHeader(keyID uint16) []byte {
+	res := make([]byte, segmentHeaderSize)
+	copy(res, segmentMagic)
+	res[4] = segmentVersion
+	binary.LittleEndian.PutUint16(res[5:], keyID)
+	return res
+}
+
+func checkSegmentHeader(header []byte) (uint16, error) {
+	if string(header[:4]) != segmentMagic {
+		return 0, fmt.Errorf("not a segment file")
+	}
+	if header[4] != segmentVersion {
+		return 0, fmt.Errorf("unsupported segment version %d", header[4])
+	}
+	return binary.LittleEndian.Uint16(header[5:]), nil
+}
+
+func readSegmentHeader(r io.Reader) (uint16, error) {
+	header := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, fmt.Errorf("cannot read segment header: %w", err)
+	}
+	return checkSegmentHeader(header)
+}
+
 type (
 	segment struct {
 		path string
+		// size is the size of the segment file and dead the number of its
+		// bytes taken by records that are no longer needed.
+		size int64
+		dead int64
+		// keyID is the ID of the key that encrypts the segment values.
+		keyID uint16
+		// pins counts the snapshots using the segment, a retired segment
+		// is removed when the last of them is closed.
+		pins    int
+		retired bool
+	}
+
+	// segmentKeys holds the latest record of every key in a single segment.
+	segmentKeys struct {
+		index   *keyIndex
+		deleted hashIndex
 	}
 
 	activeSegment struct {
 		*segment
-		io.WriteCloser
-		index map[string]int64
-		size  int64
+		*os.File
+		segmentKeys
 	}
 )
 
+func newSegmentKeys() segmentKeys {
+	return segmentKeys{
+		index:   newKeyIndex(),
+		deleted: make(hashIndex),
+	}
+}
+
+func (keys segmentKeys) put(key string, loc recordLocation) {
+	keys.index.set(key, loc)
+	delete(keys.deleted, key)
+}
+
+func (keys segmentKeys) remove(key string, loc recordLocation) {
+	keys.deleted[key] = loc
+	keys.index.delete(key)
+}
+
+// rename moves the segment file to name in the same directory.
 func (seg *segment) rename(name string) error {
 	dir := filepath.Dir(seg.path)
-	newPath := filepath.Join(dir, segmentPrefix+name)
+	newPath := filepath.Join(dir, name)
 
 	err := os.Rename(seg.path, newPath)
 	if err != nil {
@@ -37,193 +111,355 @@ func (seg *segment) rename(name string) error {
 	return nil
 }
 
-func (seg *segment) activate() (activeSegment, error) {
-	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+// activate opens the segment for appending. A new segment gets a header
+// with keyID.
+func (seg *segment) activate(perm os.FileMode, keyID uint16) (activeSegment, error) {
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, perm)
 	if err != nil {
 		return activeSegment{}, err
 	}
 	stat, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return activeSegment{}, err
 	}
+	seg.size = stat.Size()
+	if seg.size == 0 {
+		n, err := f.Write(encodeSegmentHeader(keyID))
+		if err != nil {
+			f.Close()
+			return activeSegment{}, err
+		}
+		seg.size = int64(n)
+		seg.keyID = keyID
+	}
 
 	return activeSegment{
 		segment:     seg,
-		WriteCloser: f,
-		index:       make(map[string]int64),
-		size:        stat.Size(),
+		File:        f,
+		segmentKeys: newSegmentKeys(),
 	}, nil
 }
 
 func (db *Db) newSegment(name string) (activeSegment, error) {
-	path := filepath.Join(db.dir, segmentPrefix+name)
+	path := filepath.Join(db.dir, name)
 
 	seg := &segment{
 		path: path,
 	}
 
-	return seg.activate()
+	return seg.activate(db.opts.FileMode, db.opts.Keyring.Current)
 }
 
-func (db *Db) recoverSegment(path string) error {
-	f, err := os.Open(path)
+// recoverSegment opens the segment at path and returns the latest records
+// of its keys, read from the hint file when the segment has a valid one.
+func (db *Db) recoverSegment(path string, last bool) (*segment, segmentKeys, error) {
+	stat, err := os.Stat(path)
 	if err != nil {
-		return err
+		return nil, segmentKeys{}, err
 	}
-	defer f.Close()
 
 	seg := &segment{
 		path: path,
+		size: stat.Size(),
+	}
+	if seg.size >= segmentHeaderSize {
+		if seg.keyID, err = readSegmentKeyID(path); err != nil {
+			return nil, segmentKeys{}, err
+		}
+		if _, ok := db.ciphers[seg.keyID]; seg.keyID != 0 && !ok {
+			return nil, segmentKeys{}, fmt.Errorf("segment is encrypted with unknown key %d", seg.keyID)
+		}
 	}
 
-	reader := bufio.NewReader(f)
-	var offset int64
-	for {
-		var e entry
-		n, err := e.DecodeFromReader(reader)
+	var keys segmentKeys
+	if !last {
+		keys, err = readHint(seg, stat.Size())
+	}
+	if last || err != nil {
+		keys, err = scanSegment(seg, last, db.readOnly)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if n != 0 {
-					return fmt.Errorf("corrupted file")
-				}
-				break
+			return nil, segmentKeys{}, err
+		}
+		if !last && !db.readOnly {
+			if err := writeHint(seg, stat.Size(), keys, db.opts.FileMode); err != nil {
+				fmt.Printf("recoverSegment: failed to write hint file: %v\n", err)
 			}
-			return err
 		}
-		db.index[e.key] = recordLocation{segment: seg, offset: offset}
-		offset += int64(n)
 	}
 
-	err = db.rw.addWorker(seg)
+	err = db.readers.open(seg)
 	if err != nil {
-		return fmt.Errorf("failed to add read worker: %w", err)
+		return nil, segmentKeys{}, fmt.Errorf("failed to open segment for reads: %w", err)
+	}
+	if !last {
+		db.readers.seal(seg)
 	}
 	db.segments = append(db.segments, seg)
 
-	return nil
+	return seg, keys, nil
 }
 
-func (db *Db) initNextSegment() error {
-	active, err := db.newSegment(strconv.FormatInt(time.Now().UnixNano(), 10))
+func readSegmentKeyID(path string) (uint16, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	err = db.rw.addWorker(active.segment)
+	defer f.Close()
+	return readSegmentHeader(f)
+}
+
+// scanSegment decodes every record of seg. A damaged tail of the last
+// segment is the trace of an interrupted write, so it is truncated, or
+// only skipped when readOnly; any other damage fails the scan.
+func scanSegment(seg *segment, last, readOnly bool) (segmentKeys, error) {
+	f, err := os.Open(seg.path)
 	if err != nil {
-		return fmt.Errorf("failed to add read worker: %w", err)
+		return segmentKeys{}, err
 	}
-	db.segments = append(db.segments, active.segment)
+	defer f.Close()
 
-	for key, offset := range db.activeSegment.index {
-		db.index[key] = recordLocation{
-			segment: db.activeSegment.segment,
-			offset:  offset,
-		}
+	stat, err := f.Stat()
+	if err != nil {
+		return segmentKeys{}, err
 	}
+	fileSize := stat.Size()
 
-	db.activeSegment = active
-
-	return nil
-}
-
-func (db *Db) MergeSegments() {
-	db.mu.Lock()
-	db.lockMergeSegments()
-}
-
-func (db *Db) lockMergeSegments() {
-	defer db.mu.Unlock()
-
-	oldSegments := db.segments[:len(db.segments)-1]
+	keys := newSegmentKeys()
+	cut := func(offset int64) error {
+		seg.size = offset
+		if readOnly {
+			return nil
+		}
+		return truncateTail(seg.path, offset)
+	}
 
-	mergedSeg, err := db.newSegment(strconv.FormatInt(time.Now().UnixNano(), 10))
-	if err != nil {
-		fmt.Printf("MergeSegments: failed to create merged segment: %v\n", err)
-		return
+	reader := bufio.NewReader(f)
+	offset := int64(segmentHeaderSize)
+	if fileSize < segmentHeaderSize && last {
+		if err := cut(0); err != nil {
+			return segmentKeys{}, err
+		}
+		fileSize = 0
+	} else if _, err := readSegmentHeader(reader); err != nil {
+		return segmentKeys{}, err
 	}
-	defer func() {
-		if err := mergedSeg.Close(); err != nil {
-			fmt.Printf("MergeSegments: failed to close merged segment: %v\n", err)
+
+	apply := func(e entry, loc recordLocation) {
+		if e.kind == kindDelete {
+			keys.remove(e.indexKey(), loc)
+		} else {
+			keys.put(e.indexKey(), loc)
 		}
-	}()
+	}
 
-	newIndex := make(map[string]recordLocation, len(db.index))
+	type batchRecord struct {
+		e   entry
+		loc recordLocation
+	}
+	var (
+		batch      []batchRecord
+		batchLen   int
+		batchStart int64 = -1
+	)
 
-	for _, seg := range oldSegments {
-		err := db.copyActualData(&mergedSeg, seg, newIndex)
+	for offset < fileSize {
+		var e entry
+		n, err := e.DecodeFromReader(reader)
 		if err != nil {
-			fmt.Printf("MergeSegments: failed to copy actual data from segment %s: %v\n", seg.path, err)
-			if err := os.Remove(mergedSeg.path); err != nil {
-				fmt.Printf("MergeSegments: failed to remove merged segment: %v\n", err)
+			if errors.Is(err, io.EOF) {
+				break
 			}
-			return
+			if last && isTornTail(f, err, offset, fileSize) {
+				if batchStart >= 0 {
+					offset, batchStart = batchStart, -1
+				}
+				if err := cut(offset); err != nil {
+					return segmentKeys{}, err
+				}
+				break
+			}
+			return segmentKeys{}, fmt.Errorf("offset %d: %w", offset, err)
 		}
-	}
 
-	for _, seg := range oldSegments {
-		db.rw.deleteWorker(seg)
-		if err := os.Remove(seg.path); err != nil {
-			fmt.Printf("MergeSegments: failed to delete old segments: %v\n", err)
+		loc := recordLocation{
+			segment:   seg,
+			offset:    offset,
+			size:      int64(n),
+			expiresAt: e.expiresAt,
+			seq:       e.seq,
 		}
+		switch e.kind {
+		case kindPut, kindDelete:
+			if e.bucket == 0 && reservedKey(e.key) {
+				return segmentKeys{}, fmt.Errorf("offset %d: %w: key %q", offset, ErrReservedKey, e.key)
+			}
+			if batchStart >= 0 {
+				batch = append(batch, batchRecord{e, loc})
+			} else {
+				apply(e, loc)
+			}
+		case kindBatchBegin:
+			size, ok := batchSize(e)
+			if batchStart >= 0 || !ok {
+				return segmentKeys{}, fmt.Errorf("offset %d: %w: unexpected batch begin", offset, ErrCorrupted)
+			}
+			batch, batchLen, batchStart = batch[:0], size, offset
+		case kindBatchCommit:
+			if batchStart < 0 || len(batch) != batchLen {
+				return segmentKeys{}, fmt.Errorf("offset %d: %w: unexpected batch commit", offset, ErrCorrupted)
+			}
+			for _, r := range batch {
+				apply(r.e, r.loc)
+			}
+			batchStart = -1
+		default:
+			return segmentKeys{}, fmt.Errorf("offset %d: %w: unknown record kind %d", offset, ErrCorrupted, e.kind)
+		}
+		offset += int64(n)
 	}
 
-	err = mergedSeg.rename("0")
-	if err != nil {
-		fmt.Printf("MergeSegments: failed to rename merged segment: %v\n", err)
+	if batchStart >= 0 {
+		if !last {
+			return segmentKeys{}, fmt.Errorf("offset %d: %w: incomplete batch", batchStart, ErrCorrupted)
+		}
+		if err := cut(batchStart); err != nil {
+			return segmentKeys{}, err
+		}
 	}
 
-	err = db.rw.addWorker(mergedSeg.segment)
-	if err != nil {
-		fmt.Printf("MergeSegments: failed to add merged segment in workers: %v\n", err)
-	}
-	copy(db.segments, []*segment{mergedSeg.segment, db.segments[len(db.segments)-1]})
-	db.segments = db.segments[:2]
-	db.index = newIndex
+	return keys, nil
 }
 
-func (db *Db) copyActualData(dst *activeSegment, src *segment, newIndex map[string]recordLocation) error {
-	f, err := os.Open(src.path)
-	if err != nil {
-		return fmt.Errorf("failed to open old segment: %w", err)
+// isTornTail reports whether the decoding error at offset is caused by a
+// write that was interrupted: the record runs past the end of the file, it
+// is the last record of the file, or only zero padding is left.
+func isTornTail(f *os.File, err error, offset, fileSize int64) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if !errors.Is(err, ErrCorrupted) {
+		return false
 	}
-	defer f.Close()
 
-	var readOffset int64
-	reader := bufio.NewReader(f)
+	sizeBuf := make([]byte, 4)
+	if _, err := f.ReadAt(sizeBuf, offset); err == nil {
+		size := int64(binary.LittleEndian.Uint32(sizeBuf))
+		if size >= entryMinSize && offset+size >= fileSize {
+			return true
+		}
+	}
 
+	rest := io.NewSectionReader(f, offset, fileSize-offset)
+	buf := make([]byte, 32*1024)
 	for {
-		var e entry
-		readed, err := e.DecodeFromReader(reader)
-		if err == io.EOF {
-			break
+		n, err := rest.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
 		}
 		if err != nil {
-			return fmt.Errorf("failed to read from old segment: %w", err)
+			return errors.Is(err, io.EOF)
 		}
+	}
+}
 
-		oldLoc := recordLocation{
-			segment: src,
-			offset:  readOffset,
-		}
-		readOffset += int64(readed)
+func truncateTail(path string, offset int64) error {
+	if err := os.Truncate(path, offset); err != nil {
+		return fmt.Errorf("failed to truncate torn tail: %w", err)
+	}
+	fmt.Printf("recoverSegment: truncated torn tail of %s at offset %d\n", path, offset)
+	return nil
+}
 
-		_, inActive := db.activeSegment.index[e.key]
-		if inActive || db.index[e.key] != oldLoc {
-			continue
+func (db *Db) initNextSegment() error {
+	// Whatever the sync policy, the records of the segment being closed
+	// reach the disk before the manifest names a newer one: only the last
+	// segment may have a torn tail.
+	if prev := db.activeSegment; prev.File != nil {
+		if err := db.syncFile(prev.File); err != nil {
+			return fmt.Errorf("failed to sync segment: %w", err)
 		}
-		data := e.Encode()
+	}
 
-		writed, err := dst.Write(data)
-		if err != nil {
-			return fmt.Errorf("failed to write to merged segment: %w", err)
+	active, err := db.newSegment(segmentPrefix + strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err != nil {
+		return err
+	}
+	if err := db.saveManifest(append(slices.Clone(db.segments), active.segment)); err != nil {
+		active.Close()
+		if err := os.Remove(active.path); err != nil {
+			fmt.Printf("initNextSegment: failed to remove unused segment: %v\n", err)
 		}
+		return err
+	}
+	err = db.readers.open(active.segment)
+	if err != nil {
+		return fmt.Errorf("failed to open segment for reads: %w", err)
+	}
+	db.segments = append(db.segments, active.segment)
+
+	if err := db.syncer.setFile(active.File); err != nil {
+		fmt.Printf("initNextSegment: failed to sync closed segment: %v\n", err)
+	}
 
-		newIndex[e.key] = recordLocation{
-			segment: dst.segment,
-			offset:  dst.size,
+	if prev := db.activeSegment; prev.segment != nil {
+		if err := prev.Close(); err != nil {
+			fmt.Printf("initNextSegment: failed to close segment: %v\n", err)
+		}
+		db.readers.seal(prev.segment)
+		if err := writeHint(prev.segment, prev.size, prev.segmentKeys, db.opts.FileMode); err != nil {
+			fmt.Printf("initNextSegment: failed to write hint file: %v\n", err)
+		}
+		for key, loc := range prev.index.all() {
+			db.index.set(key, loc)
 		}
-		dst.size += int64(writed)
 	}
 
+	db.activeSegment = active
+
 	return nil
 }
+
+// retireSegment takes seg out of use. A segment pinned by a snapshot is
+// moved aside and removed when the snapshot is closed. It must be called
+// under db.mu.
+func (db *Db) retireSegment(seg *segment) {
+	seg.retired = true
+	if err := removeHint(seg); err != nil {
+		fmt.Printf("retireSegment: failed to delete hint file: %v\n", err)
+	}
+
+	if seg.pins == 0 {
+		db.removeSegment(seg)
+		return
+	}
+
+	retiredPath := filepath.Join(db.dir, retiredPrefix+filepath.Base(seg.path))
+	if err := os.Rename(seg.path, retiredPath); err != nil {
+		fmt.Printf("retireSegment: failed to move pinned segment aside: %v\n", err)
+		return
+	}
+	seg.path = retiredPath
+}
+
+// garbageRatio returns the share of dead bytes among the records of seg.
+func (seg *segment) garbageRatio() float64 {
+	records := seg.size - segmentHeaderSize
+	if records <= 0 {
+		return 0
+	}
+	return float64(seg.dead) / float64(records)
+}
+
+func (seg *segment) liveBytes() int64 {
+	return seg.size - segmentHeaderSize - seg.dead
+}
+
+func (db *Db) removeSegment(seg *segment) {
+	db.readers.close(seg)
+	if err := os.Remove(seg.path); err != nil {
+		fmt.Printf("removeSegment: failed to delete segment: %v\n", err)
+	}
+}
@@ -0,0 +1,116 @@
+package datastore
+
+import "os"
+
+// Snapshot is a read-only view of the db as of the moment it was taken.
+// It pins the segments it reads from, so merges keep their files until
+// the snapshot is closed. A snapshot must be closed before its db.
+type Snapshot struct {
+	db       *Db
+	index    *keyIndex
+	segments []*segment
+	seq      uint64
+	closed   bool
+}
+
+func (db *Db) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	index := newKeyIndex()
+	for key, loc := range db.rangeKeys("", "") {
+		index.set(key, loc)
+	}
+
+	segments := make([]*segment, len(db.segments))
+	copy(segments, db.segments)
+	for _, seg := range segments {
+		seg.pins++
+	}
+
+	return &Snapshot{
+		db:       db,
+		index:    index,
+		segments: segments,
+		seq:      db.lastSeq,
+	}
+}
+
+// Seq returns the sequence number of the last write seen by the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(key string) (string, error) {
+	if reservedKey(key) {
+		return "", ErrNotFound
+	}
+	loc, ok := s.index.get(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.db.readers.get(loc)
+}
+
+// Scan works like Db.Scan on the state of the snapshot.
+func (s *Snapshot) Scan(prefix, start string, limit int) ([]KeyValue, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	prefix, start, ok := bucketRange(0, prefix, start)
+	if !ok {
+		return nil, nil
+	}
+	var res []KeyValue
+	for key, loc := range rangeIndex(s.index, prefix, start) {
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+		value, err := s.db.readers.get(loc)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, KeyValue{Key: key, Value: value})
+	}
+	return res, nil
+}
+
+func (s *Snapshot) NewIterator(prefix string) *Iterator {
+	return newIterator(s.Scan, prefix)
+}
+
+// Close releases the segments pinned by the snapshot.
+func (s *Snapshot) Close() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.db.unpinSegments(s.segments)
+	return nil
+}
+
+// openPinned opens the file of a pinned segment. A merge may move the
+// segment aside meanwhile, so its path is read under db.mu.
+func (db *Db) openPinned(seg *segment) (*os.File, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return os.Open(seg.path)
+}
+
+// unpinSegments releases segments pinned by a snapshot or a backup and
+// removes the retired ones nobody uses anymore. It must be called under
+// db.mu.
+func (db *Db) unpinSegments(segments []*segment) {
+	for _, seg := range segments {
+		seg.pins--
+		if seg.pins == 0 && seg.retired {
+			db.removeSegment(seg)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{SegmentSize: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap := db.Snapshot()
+
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("new%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key10", "value10"); err != nil {
+		t.Fatal(err)
+	}
+	db.MergeSegments()
+
+	for i := range 10 {
+		key, want := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if got, err := snap.Get(key); err != nil || got != want {
+			t.Errorf("snap.Get(%q) = %q, %v; want %q", key, got, err, want)
+		}
+	}
+	if _, err := snap.Get("key10"); err != ErrNotFound {
+		t.Errorf("snap.Get(key10) = %v; want ErrNotFound", err)
+	}
+	if got, err := db.Get("key1"); err != nil || got != "new1" {
+		t.Errorf("db.Get(key1) = %q, %v; want new1", got, err)
+	}
+
+	it := snap.NewIterator("key")
+	count := 0
+	for it.Next() {
+		if !strings.HasPrefix(it.Value(), "value") {
+			t.Errorf("Iterator returned %s = %q written after the snapshot", it.Key(), it.Value())
+		}
+		count++
+	}
+	if it.Err() != nil || count != 10 {
+		t.Errorf("Iterator returned %d records, %v; want 10", count, it.Err())
+	}
+
+	retired := func() int {
+		files, err := os.ReadDir(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), retiredPrefix) {
+				n++
+			}
+		}
+		return n
+	}
+	if retired() == 0 {
+		t.Error("Merge removed segments pinned by the snapshot")
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := retired(); n != 0 {
+		t.Errorf("%d retired segments left after closing the snapshot", n)
+	}
+}
@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Stats describes the state of a Db.
+type Stats struct {
+	Segments []SegmentStats `json:"segments"`
+	// Keys is the number of live keys.
+	Keys int `json:"keys"`
+	// LiveBytes and DeadBytes sum the bytes of records that are still
+	// needed and of those that merges will drop.
+	LiveBytes         int64 `json:"liveBytes"`
+	DeadBytes         int64 `json:"deadBytes"`
+	ActiveSegmentSize int64 `json:"activeSegmentSize"`
+
+	Merges            uint64        `json:"merges"`
+	LastMergeDuration time.Duration `json:"lastMergeDuration"`
+	MergeDuration     time.Duration `json:"mergeDuration"`
+	// LastMergeError is the error of the last merge that failed, later
+	// merges that succeed do not clear it.
+	LastMergeError     string    `json:"lastMergeError,omitempty"`
+	LastMergeErrorTime time.Time `json:"lastMergeErrorTime,omitzero"`
+
+	// Buckets describes the named buckets, Keys counts the keys of all
+	// of them.
+	Buckets []BucketStats `json:"buckets,omitempty"`
+
+	Reads  uint64     `json:"reads"`
+	Writes uint64     `json:"writes"`
+	Cache  CacheStats `json:"cache"`
+}
+
+// SegmentStats describes one segment, the active one last.
+type SegmentStats struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	LiveBytes int64  `json:"liveBytes"`
+	DeadBytes int64  `json:"deadBytes"`
+}
+
+// mergeStats counts the merges that rewrote segments.
+type mergeStats struct {
+	mu        sync.Mutex
+	count     uint64
+	last      time.Duration
+	total     time.Duration
+	lastErr   error
+	lastErrAt time.Time
+}
+
+func (s *mergeStats) record(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.last = d
+	s.total += d
+	if err != nil {
+		s.lastErr, s.lastErrAt = err, time.Now()
+	}
+}
+
+// Stats returns the sizes of the segments, key and byte counts, merge
+// history and operation counters.
+func (db *Db) Stats() Stats {
+	var stats Stats
+
+	db.mu.RLock()
+	for _, seg := range db.segments {
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name:      filepath.Base(seg.path),
+			Size:      seg.size,
+			LiveBytes: seg.liveBytes(),
+			DeadBytes: seg.dead,
+		})
+		stats.LiveBytes += seg.liveBytes()
+		stats.DeadBytes += seg.dead
+	}
+	for range db.rangeKeys("", "") {
+		stats.Keys++
+	}
+	stats.ActiveSegmentSize = db.activeSegment.size
+	for _, name := range slices.Sorted(maps.Keys(db.buckets.ids)) {
+		stats.Buckets = append(stats.Buckets, db.bucketStats(name, db.buckets.ids[name]))
+	}
+	db.mu.RUnlock()
+
+	db.mergeStats.mu.Lock()
+	stats.Merges = db.mergeStats.count
+	stats.LastMergeDuration = db.mergeStats.last
+	stats.MergeDuration = db.mergeStats.total
+	if db.mergeStats.lastErr != nil {
+		stats.LastMergeError = db.mergeStats.lastErr.Error()
+		stats.LastMergeErrorTime = db.mergeStats.lastErrAt
+	}
+	db.mergeStats.mu.Unlock()
+
+	stats.Reads = db.reads.Load()
+	stats.Writes = db.writes.Load()
+	stats.Cache = db.CacheStats()
+	return stats
+}
@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{MergePolicy: MergePolicy{MinSegments: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotate(t, db)
+	if err := db.Put("a", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := db.Stats()
+	if len(stats.Segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(stats.Segments))
+	}
+	if stats.Keys != 2 {
+		t.Errorf("Keys = %d, want 2", stats.Keys)
+	}
+	if stats.Reads != 1 || stats.Writes != 5 {
+		t.Errorf("reads, writes = %d, %d; want 1, 5", stats.Reads, stats.Writes)
+	}
+	if stats.ActiveSegmentSize != stats.Segments[1].Size {
+		t.Errorf("ActiveSegmentSize = %d, want %d", stats.ActiveSegmentSize, stats.Segments[1].Size)
+	}
+	records := stats.Segments[0].Size + stats.Segments[1].Size - 2*segmentHeaderSize
+	if stats.DeadBytes == 0 || stats.LiveBytes+stats.DeadBytes != records {
+		t.Errorf("live, dead bytes = %d, %d; want a split of %d record bytes", stats.LiveBytes, stats.DeadBytes, records)
+	}
+
+	db.MergeSegments()
+	stats = db.Stats()
+	if stats.Merges != 1 || stats.LastMergeDuration <= 0 || stats.LastMergeError != "" {
+		t.Errorf("merges = %d, last duration %v, error %q; want 1 successful merge",
+			stats.Merges, stats.LastMergeDuration, stats.LastMergeError)
+	}
+	if stats.Keys != 2 {
+		t.Errorf("Keys after merge = %d, want 2", stats.Keys)
+	}
+}
+
+func TestStats_JSON(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{CacheSize: 1024, MergePolicy: MergePolicy{MinSegments: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A merge that fails is still reported after one that succeeds.
+	mergeErr := errors.New("disk full")
+	db.mergeStats.record(time.Millisecond, mergeErr)
+	db.mergeStats.record(time.Millisecond, nil)
+
+	stats := db.Stats()
+	if stats.LastMergeError != mergeErr.Error() || stats.LastMergeErrorTime.IsZero() {
+		t.Errorf("last merge error %q at %v, want %q", stats.LastMergeError, stats.LastMergeErrorTime, mergeErr)
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"lastMergeErrorTime":`, `"cache":{"hits":0,"misses":0,"size":0,"len":0}`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("%s does not contain %s", data, field)
+		}
+	}
+}
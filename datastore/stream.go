@@ -0,0 +1,287 @@
+package datastore
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+const streamBufferSize = 64 * 1024
+
+func (db *Db) PutBytes(key string, value []byte) error {
+	return db.Put(key, string(value))
+}
+
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	value, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// PutReader stores a value of size bytes read from r. The value is
+// streamed to a temporary file in the data directory and then copied to
+// the active segment, so it is not buffered in memory and a slow r does
+// not hold up other reads and writes. With a keyring the value is sealed
+// as a whole, so it is read into memory instead.
+func (db *Db) PutReader(key string, r io.Reader, size int64) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if size < 0 {
+		return fmt.Errorf("value size must not be negative, got %d", size)
+	}
+	if err := db.checkSize(key, size); err != nil {
+		return err
+	}
+	if reservedKey(key) {
+		return ErrReservedKey
+	}
+	if db.opts.Keyring.Current != 0 {
+		// A value is sealed as a whole, so it is buffered to be encrypted.
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return fmt.Errorf("failed to read value: %w", err)
+		}
+		return db.PutBytes(key, value)
+	}
+
+	spool, err := db.spoolValue(r, size)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		spool.Close()
+		if err := os.Remove(spool.Name()); err != nil {
+			fmt.Printf("PutReader: failed to remove spooled value: %v\n", err)
+		}
+	}()
+
+	// Watchers get the value with the event. It is read from the spool
+	// with the lock released, so the check for watchers runs again once
+	// the lock is taken back.
+	var (
+		value  string
+		loaded bool
+	)
+	db.mu.Lock()
+	for len(db.watchers) > 0 && !loaded {
+		db.mu.Unlock()
+		var sb strings.Builder
+		sb.Grow(int(size))
+		if _, err := io.Copy(&sb, io.NewSectionReader(spool, 0, size)); err != nil {
+			return fmt.Errorf("failed to read spooled value: %w", err)
+		}
+		value, loaded = sb.String(), true
+		db.mu.Lock()
+	}
+
+	db.lastSeq++
+	e := entry{
+		kind: kindPut,
+		key:  key,
+		seq:  db.lastSeq,
+	}
+	recordSize := int64(e.encodedSize(int(size)))
+	syncSeq, err := db.appendRecords(recordSize, func(w io.Writer) error {
+		bw := bufio.NewWriterSize(w, streamBufferSize)
+		crc := crc32.New(crcTable)
+		out := io.MultiWriter(bw, crc)
+		if _, err := out.Write(e.encodeHeader(int(size))); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, io.NewSectionReader(spool, 0, size)); err != nil {
+			return fmt.Errorf("failed to copy spooled value: %w", err)
+		}
+		if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.indexRecords([]entry{e}, []int64{recordSize})
+	if len(db.watchers) > 0 {
+		e.value = value
+		db.notify([]entry{e})
+	}
+	_, err = db.finishWrite(syncSeq)
+	return err
+}
+
+// spoolValue copies the value of size bytes read from r to a temporary
+// file. Files left by a crash are removed on Open.
+func (db *Db) spoolValue(r io.Reader, size int64) (*os.File, error) {
+	f, err := os.CreateTemp(db.dir, spoolPrefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool value: %w", err)
+	}
+	if _, err = io.CopyN(f, r, size); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		err = fmt.Errorf("failed to read value: %w", err)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// GetReader returns a reader of the value of key that streams it from the
+// segment. The checksum of the record is verified when the value is read
+// to the end. The reader stays valid when the segment is merged away.
+func (db *Db) GetReader(key string) (io.ReadCloser, error) {
+	if reservedKey(key) {
+		return nil, ErrNotFound
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.reads.Add(1)
+	loc, ok := db.lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if loc.segment.keyID != 0 {
+		// An encrypted value is only authenticated as a whole.
+		e, err := db.readers.read(loc)
+		if err != nil {
+			return nil, err
+		}
+		if e.valueType != TypeString {
+			return nil, ErrTypeMismatch
+		}
+		return io.NopCloser(strings.NewReader(e.value)), nil
+	}
+	f, err := os.Open(loc.segment.path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newValueReader(f, loc)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// valueReader reads the value of the record at loc, inflating it when it
+// is compressed.
+type valueReader struct {
+	f          *os.File
+	checked    *checkedReader
+	value      io.Reader
+	compressed bool
+}
+
+// checkedReader reads the stored value and checks the record checksum
+// once the value is read.
+type checkedReader struct {
+	value *io.SectionReader
+	crc   uint32
+	want  uint32
+}
+
+func newValueReader(f *os.File, loc recordLocation) (*valueReader, error) {
+	// The value starts after the fixed header, the optional fields and
+	// the key.
+	head := make([]byte, min(loc.size, entryHeaderSize+entryMaxFieldsSize+4))
+	if _, err := f.ReadAt(head, loc.offset); err != nil {
+		return nil, err
+	}
+	if len(head) < entryHeaderSize || int64(binary.LittleEndian.Uint32(head)) != loc.size {
+		return nil, fmt.Errorf("%w: bad size", ErrCorrupted)
+	}
+	pos := int64(entryHeaderSize)
+	if head[5]&flagExpires != 0 {
+		pos += 8
+	}
+	if head[5]&flagSequence != 0 {
+		pos += 8
+	}
+	if head[5]&flagType != 0 {
+		if pos >= int64(len(head)) || ValueType(head[pos]) != TypeString {
+			return nil, ErrTypeMismatch
+		}
+		pos++
+	}
+	if pos+4 > int64(len(head)) {
+		return nil, fmt.Errorf("%w: bad key length", ErrCorrupted)
+	}
+	valueStart := pos + 4 + int64(binary.LittleEndian.Uint32(head[pos:])) + 4
+	if valueStart+4 > loc.size {
+		return nil, fmt.Errorf("%w: bad key length", ErrCorrupted)
+	}
+
+	header := make([]byte, valueStart)
+	if _, err := f.ReadAt(header, loc.offset); err != nil {
+		return nil, err
+	}
+	valueSize := int64(binary.LittleEndian.Uint32(header[valueStart-4:]))
+	if valueStart+valueSize+4 != loc.size {
+		return nil, fmt.Errorf("%w: bad value length", ErrCorrupted)
+	}
+	trailer := make([]byte, 4)
+	if _, err := f.ReadAt(trailer, loc.offset+loc.size-4); err != nil {
+		return nil, err
+	}
+
+	r := &valueReader{
+		f: f,
+		checked: &checkedReader{
+			value: io.NewSectionReader(f, loc.offset+valueStart, valueSize),
+			crc:   crc32.Update(0, crcTable, header),
+			want:  binary.LittleEndian.Uint32(trailer),
+		},
+	}
+	r.value = r.checked
+	if head[5]&flagCompressed != 0 {
+		r.value = flate.NewReader(r.checked)
+		r.compressed = true
+	}
+	return r, nil
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	if !r.compressed || err == nil {
+		return n, err
+	}
+	if errors.Is(err, io.EOF) {
+		// The inflater may stop before the end of the stored value, the
+		// rest is read so the checksum is verified.
+		if _, err := io.Copy(io.Discard, r.checked); err != nil {
+			return n, err
+		}
+		return n, io.EOF
+	}
+	if !errors.Is(err, ErrCorrupted) {
+		err = fmt.Errorf("%w: cannot decompress value: %v", ErrCorrupted, err)
+	}
+	return n, err
+}
+
+func (r *checkedReader) Read(p []byte) (int, error) {
+	n, err := r.value.Read(p)
+	r.crc = crc32.Update(r.crc, crcTable, p[:n])
+	if errors.Is(err, io.EOF) && r.crc != r.want {
+		return n, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	return n, err
+}
+
+func (r *valueReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,159 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPutReader(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 64 * 1024}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(blob)
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("blob", bytes.NewReader(blob), int64(len(blob))); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		r, err := db.GetReader("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, blob) {
+			t.Error("GetReader returned a different value")
+		}
+		if got, err := db.GetBytes("blob"); err != nil || !bytes.Equal(got, blob) {
+			t.Errorf("GetBytes returned a different value, error %v", err)
+		}
+	}
+	check(t, db)
+
+	t.Run("short reader", func(t *testing.T) {
+		err := db.PutReader("blob", bytes.NewReader(blob[:100]), int64(len(blob)))
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("PutReader error = %v; want io.ErrUnexpectedEOF", err)
+		}
+		check(t, db)
+		if err := db.PutBytes("after", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("slow reader", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- db.PutReader("slow", pr, 10)
+		}()
+		if _, err := pw.Write([]byte("slow")); err != nil {
+			t.Fatal(err)
+		}
+
+		// Other writes and reads go on while the value is being read.
+		if err := db.Put("during", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.Get("during"); err != nil || got != "value" {
+			t.Errorf("Get(during) = %q, %v; want value", got, err)
+		}
+
+		if _, err := pw.Write([]byte(" value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if got, err := db.Get("slow"); err != nil || got != "slow value" {
+			t.Errorf("Get(slow) = %q, %v; want slow value", got, err)
+		}
+		files, err := os.ReadDir(tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), spoolPrefix) {
+				t.Errorf("Spooled value %s was not removed", f.Name())
+			}
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, db)
+		if got, err := db.GetBytes("after"); err != nil || string(got) != "value" {
+			t.Errorf("GetBytes(after) = %q, %v; want value", got, err)
+		}
+	})
+
+	t.Run("corrupted value", func(t *testing.T) {
+		db.mu.RLock()
+		loc, _ := db.lookup("blob")
+		db.mu.RUnlock()
+		f, err := os.OpenFile(loc.segment.path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{^blob[len(blob)/2]}, loc.offset+loc.size-4-int64(len(blob)/2)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		r, err := db.GetReader("blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("reading corrupted value error = %v; want ErrCorrupted", err)
+		}
+	})
+	db.Close()
+}
+
+func TestSizeLimits(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{MaxKeySize: 4, MaxValueSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("long key", "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Put with long key error = %v; want ErrKeyTooLarge", err)
+	}
+	if err := db.Put("key", "long value"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Put with long value error = %v; want ErrValueTooLarge", err)
+	}
+	if err := db.PutReader("key", bytes.NewReader(make([]byte, 9)), 9); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutReader with long value error = %v; want ErrValueTooLarge", err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Errorf("Put within limits failed: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// syncer flushes the active segment to disk. Writers that wait for the
+// flush at the same time share a single fsync call.
+type syncer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	written uint64
+	synced  uint64
+	syncing bool
+}
+
+func newSyncer() *syncer {
+	s := &syncer{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// add registers a record written to the active segment and returns the
+// sequence number to wait for. It must be called under db.mu.
+func (s *syncer) add() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written++
+	return s.written
+}
+
+// wait blocks until the record with sequence number seq is on disk. The
+// first waiter syncs the file on behalf of everybody written so far.
+func (s *syncer) wait(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.synced < seq {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+
+		s.syncing = true
+		target, f := s.written, s.file
+		s.mu.Unlock()
+		err := f.Sync()
+		s.mu.Lock()
+		s.syncing = false
+		if err == nil {
+			s.synced = target
+		}
+		s.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush syncs everything written so far.
+func (s *syncer) flush() error {
+	s.mu.Lock()
+	seq := s.written
+	s.mu.Unlock()
+	return s.wait(seq)
+}
+
+// setFile flushes the current file and switches the syncer to f. It must
+// be called under db.mu before the current file is closed.
+func (s *syncer) setFile(f *os.File) error {
+	var err error
+	if s.file != nil {
+		err = s.flush()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = f
+	return err
+}
+
+func (db *Db) runPeriodicSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.syncer.flush(); err != nil {
+				fmt.Printf("periodic sync: %v\n", err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ValueType is the type of a stored value.
+type ValueType byte
+
+const (
+	TypeString ValueType = iota
+	TypeInt64
+)
+
+var ErrTypeMismatch = errors.New("value has a different type")
+
+var valueTypeNames = map[ValueType]string{
+	TypeString: "string",
+	TypeInt64:  "int64",
+}
+
+func (t ValueType) String() string {
+	if name, ok := valueTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ValueType(%d)", int(t))
+}
+
+// ParseValueType returns the type with the given name.
+func ParseValueType(name string) (ValueType, error) {
+	for t, typeName := range valueTypeNames {
+		if typeName == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown value type %q", name)
+}
+
+// TypedValue is a stored value with its type and version. Only the field
+// of the value type is set.
+type TypedValue struct {
+	Type    ValueType
+	String  string
+	Int64   int64
+	Version uint64
+}
+
+func encodeInt64(v int64) string {
+	return string(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+}
+
+func decodeInt64(value string) (int64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("%w: bad int64 value", ErrCorrupted)
+	}
+	return int64(binary.LittleEndian.Uint64([]byte(value))), nil
+}
+
+// stringValue returns the value in the form returned by Get: integers
+// are formatted in decimal.
+func (e *entry) stringValue() string {
+	if e.valueType == TypeInt64 {
+		if v, err := decodeInt64(e.value); err == nil {
+			return strconv.FormatInt(v, 10)
+		}
+	}
+	return e.value
+}
+
+func (e *entry) typedValue() (TypedValue, error) {
+	res := TypedValue{Type: e.valueType, Version: e.seq}
+	switch e.valueType {
+	case TypeString:
+		res.String = e.value
+	case TypeInt64:
+		v, err := decodeInt64(e.value)
+		if err != nil {
+			return TypedValue{}, err
+		}
+		res.Int64 = v
+	default:
+		return TypedValue{}, fmt.Errorf("%w: unknown value type %d", ErrCorrupted, e.valueType)
+	}
+	return res, nil
+}
+
+func (db *Db) PutInt64(key string, value int64) error {
+	return db.write(entry{
+		kind:      kindPut,
+		key:       key,
+		value:     encodeInt64(value),
+		valueType: TypeInt64,
+	})
+}
+
+// GetInt64 returns the integer stored by PutInt64 or Increment, or
+// ErrTypeMismatch when key holds a value of another type.
+func (db *Db) GetInt64(key string) (int64, error) {
+	v, err := db.GetTyped(key)
+	if err != nil {
+		return 0, err
+	}
+	if v.Type != TypeInt64 {
+		return 0, ErrTypeMismatch
+	}
+	return v.Int64, nil
+}
+
+// GetTyped returns the value of key with its type and version.
+func (db *Db) GetTyped(key string) (TypedValue, error) {
+	if reservedKey(key) {
+		return TypedValue{}, ErrNotFound
+	}
+	if db.readSem != nil {
+		db.readSem <- struct{}{}
+		defer func() { <-db.readSem }()
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.reads.Add(1)
+	loc, ok := db.lookup(key)
+	if !ok {
+		return TypedValue{}, ErrNotFound
+	}
+	e, err := db.readers.read(loc)
+	if err != nil {
+		return TypedValue{}, err
+	}
+	return e.typedValue()
+}
+
+// Increment atomically adds delta to the integer stored at key and returns
+// the result. A missing key counts as zero; a key of another type fails
+// with ErrTypeMismatch. The new value never expires.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	var res int64
+	entries := []entry{{
+		kind:      kindPut,
+		key:       key,
+		valueType: TypeInt64,
+	}}
+	// The value is only known under the write lock, so cond fills in the
+	// entry that writeIf then encodes.
+	_, err := db.writeIf(func() error {
+		var current int64
+		if loc, ok := db.lookup(key); ok {
+			e, err := db.readers.read(loc)
+			if err != nil {
+				return err
+			}
+			if e.valueType != TypeInt64 {
+				return ErrTypeMismatch
+			}
+			if current, err = decodeInt64(e.value); err != nil {
+				return err
+			}
+		}
+		res = current + delta
+		entries[0].value = encodeInt64(res)
+		return nil
+	}, entries...)
+	if err != nil {
+		return 0, err
+	}
+	return res, nil
+}
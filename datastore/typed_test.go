@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestTypedValues(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 256}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutInt64("counter", -42); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetInt64("counter"); err != nil || v != -42 {
+		t.Errorf("GetInt64(counter) = %d, %v; want -42", v, err)
+	}
+	if v, err := db.Get("counter"); err != nil || v != "-42" {
+		t.Errorf("Get(counter) = %q, %v; want -42", v, err)
+	}
+	if _, err := db.GetInt64("name"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetInt64(name) error = %v; want ErrTypeMismatch", err)
+	}
+	if _, err := db.Increment("name", 1); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Increment(name) error = %v; want ErrTypeMismatch", err)
+	}
+	if _, err := db.GetReader("counter"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetReader(counter) error = %v; want ErrTypeMismatch", err)
+	}
+
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				if _, err := db.Increment("hits", 1); err != nil {
+					t.Errorf("Increment failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(t *testing.T, db *Db) {
+		t.Helper()
+		v, err := db.GetTyped("hits")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Type != TypeInt64 || v.Int64 != workers*increments {
+			t.Errorf("GetTyped(hits) = %v %d; want int64 %d", v.Type, v.Int64, workers*increments)
+		}
+		if v, err := db.GetTyped("name"); err != nil || v.Type != TypeString || v.String != "value" {
+			t.Errorf("GetTyped(name) = %+v, %v; want string value", v, err)
+		}
+	}
+	check(t, db)
+
+	db.MergeSegments()
+	check(t, db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(t, db)
+	if v, err := db.Increment("hits", -1); err != nil || v != workers*increments-1 {
+		t.Errorf("Increment(hits, -1) = %d, %v; want %d", v, err, workers*increments-1)
+	}
+}
@@ -0,0 +1,289 @@
+package datastore
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// watchQueueSize is the number of events a watcher may fall behind the
+// writes before it is dropped.
+const watchQueueSize = 4096
+
+// EventKind tells whether an event stores or deletes a key.
+type EventKind byte
+
+const (
+	EventPut EventKind = iota
+	EventDelete
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+}
+
+// Event is a change of a key. Value is set for puts only, its Version is
+// the sequence number of the event.
+type Event struct {
+	Kind  EventKind
+	Key   string
+	Value TypedValue
+	Seq   uint64
+}
+
+// watcher queues the changes of the keys with prefix until its goroutine
+// delivers them. Writers never wait for a watcher: one that falls too far
+// behind is overflowed and its channel is closed.
+type watcher struct {
+	prefix   string
+	mu       sync.Mutex
+	queue    []entry
+	overflow bool
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// push queues the changes of entries that match the prefix.
+func (w *watcher) push(entries []entry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.overflow {
+		return
+	}
+	for _, e := range entries {
+		if e.kind != kindPut && e.kind != kindDelete || e.bucket != 0 || !strings.HasPrefix(e.key, w.prefix) {
+			continue
+		}
+		if len(w.queue) >= watchQueueSize {
+			w.overflow, w.queue = true, nil
+			break
+		}
+		w.queue = append(w.queue, e)
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) cancel() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Watch returns a channel of the puts and deletes of the keys with the
+// prefix in commit order, starting with the next write. Events are sent
+// once the write is done, which may be before it is synced. The channel
+// is closed by cancel, by Close of the db or when the receiver falls
+// behind by more than 4096 events; WatchFrom picks up from the last
+// event received.
+func (db *Db) Watch(prefix string) (<-chan Event, func()) {
+	return db.watch(prefix, 0, false)
+}
+
+// WatchFrom is Watch that first replays the changes with sequence numbers
+// after seq from the segments. Merges keep only the latest record of a
+// key and drop tombstones no older segment needs, so the replay misses
+// the changes merged away since seq.
+func (db *Db) WatchFrom(prefix string, seq uint64) (<-chan Event, func()) {
+	return db.watch(prefix, seq, true)
+}
+
+func (db *Db) watch(prefix string, from uint64, replay bool) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	out := make(chan Event)
+
+	db.mu.Lock()
+	db.watchers[w] = struct{}{}
+	var (
+		segments []*segment
+		sizes    []int64
+		to       = db.lastSeq
+	)
+	if replay {
+		segments = slices.Clone(db.segments)
+		sizes = make([]int64, len(segments))
+		for i, seg := range segments {
+			seg.pins++
+			sizes[i] = seg.size
+		}
+	}
+	db.mu.Unlock()
+
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		defer close(out)
+		defer func() {
+			db.mu.Lock()
+			delete(db.watchers, w)
+			db.mu.Unlock()
+		}()
+
+		send := func(e entry) bool {
+			event, err := newEvent(e)
+			if err != nil {
+				fmt.Printf("watch: failed to decode %s: %v\n", e.key, err)
+				return false
+			}
+			select {
+			case out <- event:
+				return true
+			case <-w.stop:
+			case <-db.done:
+			}
+			return false
+		}
+
+		if replay {
+			ok, err := db.replay(segments, sizes, prefix, from, to, send)
+			db.mu.Lock()
+			db.unpinSegments(segments)
+			db.mu.Unlock()
+			if err != nil {
+				fmt.Printf("watch: failed to replay changes: %v\n", err)
+			}
+			if !ok || err != nil {
+				return
+			}
+		}
+
+		for {
+			// An event leaves the queue once it is sent, so the queue
+			// limit counts it until then.
+			w.mu.Lock()
+			if w.overflow {
+				w.mu.Unlock()
+				return
+			}
+			if len(w.queue) > 0 {
+				e := w.queue[0]
+				w.mu.Unlock()
+				if !send(e) {
+					return
+				}
+				w.mu.Lock()
+				if len(w.queue) > 0 {
+					w.queue = w.queue[1:]
+				}
+				w.mu.Unlock()
+				continue
+			}
+			w.mu.Unlock()
+
+			select {
+			case <-w.wake:
+			case <-w.stop:
+				return
+			case <-db.done:
+				return
+			}
+		}
+	}()
+
+	return out, w.cancel
+}
+
+// notify passes the records just written to the watchers. It must be
+// called under db.mu with records that are not encrypted.
+func (db *Db) notify(entries []entry) {
+	for w := range db.watchers {
+		w.push(entries)
+	}
+}
+
+// replay sends the changes of the keys with prefix with sequence numbers
+// in (from, to] found in the first sizes bytes of the pinned segments. It
+// reports whether send took all of them.
+func (db *Db) replay(segments []*segment, sizes []int64, prefix string, from, to uint64, send func(entry) bool) (bool, error) {
+	var records []recordLocation
+	for i, seg := range segments {
+		segRecords, err := db.findChanges(seg, sizes[i], prefix, from, to)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", filepath.Base(seg.path), err)
+		}
+		records = append(records, segRecords...)
+	}
+	// Merged segments hold records of several segments, so the segment
+	// order is not the commit order.
+	slices.SortFunc(records, func(a, b recordLocation) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	// The records are read again through the readers, which keep the
+	// pinned segments open.
+	for _, loc := range records {
+		db.mu.RLock()
+		e, err := db.readers.read(loc)
+		db.mu.RUnlock()
+		if err != nil {
+			return false, err
+		}
+		if !send(e) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// findChanges lists the puts and deletes of the keys with prefix with
+// sequence numbers in (from, to] among the first size bytes of seg.
+func (db *Db) findChanges(seg *segment, size int64, prefix string, from, to uint64) ([]recordLocation, error) {
+	f, err := db.openPinned(seg)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(io.NewSectionReader(f, 0, size))
+	if _, err := readSegmentHeader(reader); err != nil {
+		return nil, err
+	}
+	offset := int64(segmentHeaderSize)
+
+	var records []recordLocation
+	for offset < size {
+		var e entry
+		n, err := e.DecodeFromReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		if (e.kind == kindPut || e.kind == kindDelete) && e.bucket == 0 && e.seq > from && e.seq <= to &&
+			strings.HasPrefix(e.key, prefix) {
+			records = append(records, recordLocation{segment: seg, offset: offset, size: int64(n), seq: e.seq})
+		}
+		offset += int64(n)
+	}
+	return records, nil
+}
+
+// newEvent turns a record that is not encrypted into an event.
+func newEvent(e entry) (Event, error) {
+	if e.kind == kindDelete {
+		return Event{Kind: EventDelete, Key: e.key, Seq: e.seq}, nil
+	}
+	if err := e.decompress(); err != nil {
+		return Event{}, err
+	}
+	value, err := e.typedValue()
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Kind: EventPut, Key: e.key, Value: value, Seq: e.seq}, nil
+}
@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recvEvents reads n events from ch or fails after a timeout.
+func recvEvents(t *testing.T, ch <-chan Event, n int) []Event {
+	t.Helper()
+	var events []Event
+	for len(events) < n {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %d events, want %d", len(events), n)
+			}
+			events = append(events, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+	}
+	return events
+}
+
+// eventString formats e for comparisons, without its sequence number.
+func eventString(e Event) string {
+	switch {
+	case e.Kind == EventDelete:
+		return "delete " + e.Key
+	case e.Value.Type == TypeInt64:
+		return fmt.Sprintf("put %s=%d", e.Key, e.Value.Int64)
+	default:
+		return fmt.Sprintf("put %s=%s", e.Key, e.Value.String)
+	}
+}
+
+func checkEvents(t *testing.T, events []Event, want []string) {
+	t.Helper()
+	for i, e := range events {
+		if got := eventString(e); got != want[i] {
+			t.Errorf("event %d = %s, want %s", i, got, want[i])
+		}
+		if e.Kind == EventPut && e.Value.Version != e.Seq {
+			t.Errorf("event %d: version %d, seq %d", i, e.Value.Version, e.Seq)
+		}
+		if i > 0 && e.Seq <= events[i-1].Seq {
+			t.Errorf("event %d: seq %d after %d", i, e.Seq, events[i-1].Seq)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{
+		Compression: CompressionOnPut,
+		Keyring:     Keyring{Current: 1, Keys: map[uint16][]byte{1: make([]byte, 32)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("a0", "before"); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := db.Watch("a")
+
+	long := strings.Repeat("long value ", 100)
+	if err := db.Put("a1", long); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b1", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Increment("a2", 5); err != nil {
+		t.Fatal(err)
+	}
+	var b WriteBatch
+	b.Put("a3", "batched")
+	b.Delete("a1")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader("a4", strings.NewReader("streamed"), 8); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEvents(t, recvEvents(t, events, 5), []string{
+		"put a1=" + long,
+		"put a2=5",
+		"put a3=batched",
+		"delete a1",
+		"put a4=streamed",
+	})
+
+	// The channel is closed and cancel may be called again.
+	cancel()
+	for range events {
+	}
+	cancel()
+}
+
+func TestWatchFrom(t *testing.T) {
+	opts := Options{SegmentSize: 128, MergePolicy: MergePolicy{MinSegments: -1}}
+	db, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key0", "old"); err != nil {
+		t.Fatal(err)
+	}
+	_, from, err := db.GetWithVersion("key0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	rotate(t, db)
+	db.MergeSegments()
+	if err := db.Put("key2", "unmerged"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := db.WatchFrom("key", from)
+	defer cancel()
+	if err := db.Put("key3", "live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The merge dropped the records written over and the tombstone of key1.
+	checkEvents(t, recvEvents(t, events, 6), []string{
+		"put key0=value5",
+		"put key2=value7",
+		"put key3=value8",
+		"put key4=value9",
+		"put key2=unmerged",
+		"put key3=live",
+	})
+}
+
+func TestWatch_Overflow(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	events, cancel := db.Watch("")
+	defer cancel()
+	for i := range watchQueueSize + 10 {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if n >= watchQueueSize+10 {
+					t.Errorf("got all %d events before the channel was closed", n)
+				}
+				return
+			}
+			n++
+		case <-timeout:
+			t.Fatalf("channel of a watcher that fell behind is not closed after %d events", n)
+		}
+	}
+}